@@ -2,287 +2,4534 @@ package main
 
 import (
 	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"image/color"
+	"io"
+	"log"
+	"math"
+	"math/rand"
+	"mime/multipart"
+	"net"
 	"net/http"
-	"net/http/pprof"
+	"net/http/cookiejar"
+	"net/http/httptrace"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"regexp"
 	"runtime"
 	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
+	"text/template"
 	"time"
 
-	"github.com/gonum/plot"
-	"github.com/gonum/plot/plotter"
-	"github.com/gonum/plot/vg"
 	"github.com/shirou/gopsutil/cpu"
+	"golang.org/x/net/http/httpproxy"
+	"golang.org/x/net/http2"
+	"golang.org/x/term"
+	"gonum.org/v1/plot"
+	"gonum.org/v1/plot/plotter"
+	"gonum.org/v1/plot/plotutil"
+	"gonum.org/v1/plot/vg"
 )
 
 var (
-    server   = flag.String("server", "", "URL of the server to benchmark")
+    server   = flag.String("server", "", "URL of the server to benchmark; ${VAR} is filled in from the environment, and {{.Seq}} and {{.Rand}} per request with -template")
     concurrency = flag.Int("concurrency", 10, "Number of concurrent requests")
-    duration = flag.Duration("duration", 10*time.Second, "Duration of the benchmark test")
+    duration = flag.Duration("duration", 10*time.Second, "Duration of the benchmark test; 0 runs until interrupted with Ctrl-C, then reports as usual (ignored when -requests is set)")
     method       = flag.String("method", "GET", "HTTP method to use")
-    headers      = flag.String("headers", "", "Headers to include in the request (comma-separated key=value pairs)")
-    payload      = flag.String("payload", "", "Payload to send with the request")
+    methodWeights = flag.String("method-weights", "", "Mix HTTP methods by weight instead of -method, e.g. GET:70,POST:30; append :@file to give a method its own payload")
+    headers      = flag.String("headers", "", "Headers to include in the request as comma-separated key=value pairs; escape literal commas as \\, (prefer -H); ${VAR} is filled in from the environment")
+    payload      = flag.String("payload", "", "Payload to send with the request; ${VAR} is filled in from the environment, and {{.Seq}} and {{.Rand}} per request with -template")
+    payloadFile  = flag.String("payload-file", "", "File to read the request payload from (overrides -payload)")
+    payloadDir   = flag.String("payload-dir", "", "Directory of payload files; each request sends one of them picked at random")
+    useTemplates = flag.Bool("template", false, "Treat -server and -payload or -payload-file as Go templates, filling in {{.Seq}} and {{.Rand}} per request; without it they are sent as is, even if they contain {{")
+    streamSize   = flag.Int64("stream-size", 0, "Send this many bytes of generated data as a chunked request body, produced while it is sent instead of held in memory")
+    timeout      = flag.Duration("timeout", 30*time.Second, "Maximum time to wait for a single request")
+    output       = flag.String("output", "text", "Results format: text or json")
+    rampUp       = flag.Duration("ramp-up", 0, "Period over which workers are started, scaling linearly from 1 to -concurrency")
+    arrivalRate  = flag.Float64("arrival-rate", 0, "Open model: start requests at this mean rate per second with Poisson arrivals, whether or not earlier ones have finished (replaces -concurrency)")
+    maxInflight  = flag.Int("max-inflight", 1000, "Most requests in flight at once with -arrival-rate; later arrivals wait, and the wait counts toward their response time")
+    rateLimit    = flag.Float64("rate", 0, "Target requests per second across all workers (0 = unlimited)")
+    pipeline     = flag.Int("pipeline", 0, "Pipeline this many HTTP/1.1 requests on each connection before reading the responses, and compare the throughput with a baseline without pipelining (0 = off)")
+    maxRPS       = flag.Float64("max-rps", 0, "Never send more than this many requests per second, whatever the mode, as a safety cap for shared servers (0 = no cap)")
+    totalRequests = flag.Int64("requests", 0, "Total number of requests to send; takes precedence over -duration")
+    repeat       = flag.Int("repeat", 1, "Run the benchmark this many times and report how much p99 and throughput vary between runs")
+    cooldown     = flag.Duration("cooldown", 2*time.Second, "Pause between -repeat runs or -find-knee levels")
+    findKnee     = flag.Bool("find-knee", false, "Double the concurrency from 1 until throughput stops rising, and report the throughput and latency of each level and the knee where it saturated")
+    kneeStep     = flag.Duration("knee-step", 5*time.Second, "How long -find-knee runs each concurrency level")
+    kneeGain     = flag.Float64("knee-gain", 10, "Percent rise in throughput a doubling of concurrency must give for -find-knee to keep going")
+    maxConcurrency = flag.Int("max-concurrency", 1024, "Highest concurrency -find-knee tries")
+    kneeCSV      = flag.String("knee-csv", "knee.csv", "File -find-knee writes the throughput and latency of each concurrency level to")
+    latencyWindow = flag.Duration("window", 0, "Also report the median and p99 of the requests started in each window of this length, to spot latency drifting over a long run")
+    seed         = flag.Int64("seed", 0, "Seed for random URL order, methods, think time, arrivals and {{.Rand}} values, to replay a run; 0 picks one and logs it")
+    autoStop     = flag.Bool("auto-stop", false, "Stop early once the p99 settles: when it changes by less than -stability-threshold between -stability-windows successive windows; -duration is the maximum")
+    stabilityThreshold = flag.Float64("stability-threshold", 5, "Percent change in p99 between windows that -auto-stop counts as stable")
+    stabilityWindow = flag.Duration("stability-window", 5*time.Second, "Length of the windows whose p99 -auto-stop compares")
+    stabilityWindows = flag.Int("stability-windows", 3, "Consecutive stable windows -auto-stop waits for")
+    insecure     = flag.Bool("insecure", false, "Skip TLS certificate verification")
+    tlsSessionCache = flag.Bool("tls-session-cache", false, "Cache TLS sessions so new connections can resume them instead of doing a full handshake; off by default, so every new connection pays for a full handshake as in earlier versions")
+    caCert       = flag.String("cacert", "", "PEM file with CA certificates used to verify the server")
+    clientCert   = flag.String("cert", "", "PEM client certificate for mutual TLS (requires -key)")
+    clientKey    = flag.String("key", "", "PEM client private key for mutual TLS (requires -cert)")
+    urlsFile     = flag.String("urls-file", "", "File with one URL per line to benchmark instead of -server")
+    script       = flag.String("script", "", "YAML or JSON file of request steps, each with its own method, URL, headers, payload, checks and captured variables, that every worker runs in a loop instead of -server; each step counts as a request")
+    urlOrder     = flag.String("url-order", "roundrobin", "Order in which -urls-file entries are used: roundrobin or random")
+    warmup       = flag.Duration("warmup", 0, "Period at the start of the run whose requests are sent but not recorded")
+    warmupReqs   = flag.Int("warmup-requests", 0, "Number of requests each worker sends before recording any, e.g. to leave connection setup out; like -warmup requests, they don't count toward -requests")
+    keepSamples  = flag.Bool("keep-samples", false, "Keep every request sample in memory instead of only histograms of them, for exact percentiles; implied by -csv, -raw-out, -timeline, -html, -bootstrap, -window and -mode burst, which need the samples")
+    csvFile      = flag.String("csv", "", "Write every request's timestamp, response time, status and size to this CSV file")
+    mode         = flag.String("mode", "steady", "Load pattern: steady or burst")
+    timeline     = flag.Bool("timeline", false, "Also plot response time, throughput and client resource usage against elapsed time to latency_timeline.png, throughput.png and resource_usage.png")
+    perCPU       = flag.Bool("per-cpu", false, "Sample client CPU usage per core as well as overall")
+    rpsCSVFile   = flag.String("throughput-csv", "", "Write the number of requests completed in each second of the run to this CSV file")
+    bootstrap    = flag.Int("bootstrap", 0, "Resample the response times this many times to report a confidence interval around each percentile, e.g. 1000 (0 = off)")
+    confidence   = flag.Float64("confidence", 95, "Confidence level in percent of the -bootstrap intervals")
+    bins         = flag.Int("bins", 20, "Number of bins in the response time histogram")
+    logScale     = flag.Bool("log-scale", false, "Plot histogram counts on a logarithmic axis to show the tail")
+    targetLatency = flag.Duration("target-latency", 0, "Mark this response time budget on the histogram, with the bins beyond it in red and the percentage of requests over it in the title")
+    noPlot       = flag.Bool("no-plot", false, "Skip all charts, both the PNG files and those in the -html report")
+    outputDir    = flag.String("output-dir", "", "Directory for generated files (plots, -csv, -html and, in JSON mode, results.json), created if needed")
+    runName      = flag.String("name", "", "Prefix for generated plot and results file names, e.g. -name run1 writes run1_response_times.png")
+    forceHTTP2   = flag.Bool("http2", false, "Require HTTP/2 over TLS")
+    http2Only    = flag.Bool("http2-only", false, "Speak cleartext HTTP/2 (h2c) without TLS or HTTP/1.1 fallback")
+    basicAuth    = flag.String("basic-auth", "", "Send HTTP basic auth credentials given as user:pass; ${VAR} is filled in from the environment")
+    bearerToken  = flag.String("bearer", "", "Send an Authorization: Bearer header with this token; ${VAR} is filled in from the environment")
+    sign         = flag.String("sign", "", "Sign every request: aws-sigv4 with credentials from AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and AWS_SESSION_TOKEN, or hmac with -sign-secret")
+    signRegion   = flag.String("sign-region", "", "AWS region for -sign aws-sigv4 (default $AWS_REGION, then $AWS_DEFAULT_REGION)")
+    signService  = flag.String("sign-service", "", "AWS service name for -sign aws-sigv4, e.g. execute-api or s3")
+    signSecret   = flag.String("sign-secret", "", "Secret for -sign hmac, which sets X-Timestamp and an X-Signature over the method, path, timestamp and body")
+    acceptEncoding = flag.String("accept-encoding", "gzip", "Accept-Encoding header to send; gzip and deflate responses are decoded and their compression reported (empty = send none)")
+    followRedirs = flag.Bool("follow-redirects", true, "Follow redirects; -follow-redirects=false records 3xx responses as the final response")
+    keepAlive    = flag.Bool("keepalive", true, "Reuse connections between requests; -keepalive=false opens a new connection for every request")
+    maxIdleConns = flag.Int("max-idle-conns", 0, "Idle connections kept open per host for reuse (0 = match -concurrency)")
+    failFast     = flag.Bool("fail-fast", false, "Before the run, send one request and retry it a few times with backoff until the server responds, exiting with the error if it never does")
+    waitForSrv   = flag.Duration("wait-for-server", 0, "Like -fail-fast, but keep retrying for up to this long, e.g. while a fresh deploy starts (0 = don't wait)")
+    dryRun       = flag.Bool("dry-run", false, "Print the first request exactly as it would be sent, then exit without contacting the server")
+    selfTest     = flag.Bool("self-test", false, "Benchmark a built-in server with a fixed 20ms latency instead of -server and check that the measured latency matches, to verify the tool and this machine")
+    prometheusOut = flag.String("prometheus-out", "", "Write request counts, error counts and a response time histogram in Prometheus text format to this file at the end of the run")
+    hdrOut       = flag.String("hdr-out", "", "Write the response times as an HdrHistogram to this file: a percentile distribution in milliseconds for a .hgrm file, as read by hdr-plot, and otherwise a compressed histogram log")
+    metricsPort  = flag.Int("metrics-port", 0, "Serve the -prometheus-out metrics live at /metrics on this port while the run goes (0 = off)")
+    rawOut       = flag.String("raw-out", "", "Save every request sample in a compact binary file that -analyze can re-read")
+    analyzeFile  = flag.String("analyze", "", "Recompute the statistics, plots and reports from a -raw-out file instead of running a benchmark")
+    configFile   = flag.String("config", "", "Read settings from this YAML or JSON scenario file, keyed by flag name; flags given on the command line take precedence")
+    compare      = flag.String("compare", "", "Compare two JSON result files given as old.json,new.json instead of running a benchmark")
+    threshold    = flag.Float64("threshold", 10, "Percent change tolerated by -compare before a metric counts as a regression")
+    expectStatus = flag.Int("expect-status", 0, "Count responses with any other status code as validation failures")
+    hashBodies   = flag.Bool("hash-bodies", false, "Hash every response body and report how many distinct bodies came back, keeping a few of them, to catch an endpoint that should be constant varying under load")
+    expectRegex  = flag.String("expect-body-regex", "", "Count responses whose body does not match this regular expression as validation failures")
+    htmlFile     = flag.String("html", "", "Write a self-contained HTML report with the statistics and charts to this file")
+    connections  = flag.Int("connections", 0, "Maximum TCP connections per host, independent of -concurrency (0 = unlimited)")
+    clientCount  = flag.Int("client-count", 0, "Simulate this many independent clients, each with its own connection pool and cookie jar, and spread the workers over them (0 = one shared client)")
+    useCookies   = flag.Bool("cookies", false, "Give each worker a cookie jar so cookies set by responses are sent on its later requests")
+    thinkTime    = flag.Duration("think-time", 0, "Pause each worker for this long between its requests")
+    thinkJitter  = flag.Duration("think-jitter", 0, "Add a uniformly random delay of up to this much to each -think-time pause")
+    bodyLimit    = flag.Int64("body-limit", 0, "Stop timing a response after this many body bytes; the rest is read but not timed (0 = no limit)")
+    drainTimeout = flag.Duration("drain-timeout", 5*time.Second, "Grace period for requests in flight when the run ends; they are recorded if they finish within it and dropped otherwise")
+    maxErrors    = flag.Int64("max-errors", 0, "Stop the run early, report the partial results and exit with status 1 once this many requests have failed (0 = never)")
+    verbose      = flag.Bool("verbose", false, "Log the method, URL, status and duration of every request to stderr; slows down high request rates")
+    verboseErrs  = flag.Bool("verbose-errors-only", false, "Like -verbose, but only log requests that failed")
+    slaP99       = flag.Duration("sla-p99", 0, "Exit with status 1 if the 99th percentile response time exceeds this")
+    slaErrorRate = flag.String("sla-error-rate", "", "Exit with status 1 if the percentage of failed requests exceeds this, e.g. 1%")
+    protocol     = flag.String("protocol", "http", "Protocol to benchmark: http, grpc, ws for WebSocket echo round trips, or tcp for raw connect and payload round-trip times")
+    grpcMethod   = flag.String("grpc-method", "", "Unary method to call in grpc mode as package.Service/Method, looked up through server reflection")
+    proxyURL     = flag.String("proxy", "", "Send requests through this http://, https:// or socks5:// proxy, skipping hosts listed in NO_PROXY")
+    burstDuration    = flag.Duration("burst-duration", 5*time.Second, "Length of each burst phase in burst mode")
+    burstConcurrency = flag.Int("burst-concurrency", 100, "Number of concurrent workers during a burst phase")
+    restDuration     = flag.Duration("rest-duration", 10*time.Second, "Idle time between bursts in burst mode")
+)
+
+// interrupted is set when the run was cut short by a signal.
+var interrupted int32
+
+// autoStopped is set when -auto-stop ended the run before -duration.
+var autoStopped int32
+
+// errorBudgetExceeded is set when the run was cut short by -max-errors.
+// stopRun cancels the run as a whole; main replaces it once the run's
+// context exists.
+var (
+    errorBudgetExceeded int32
+    stopRun             context.CancelFunc = func() {}
+)
+
+// exitCode is the process exit status, set by the benchmark when a run
+// could not produce results.
+var exitCode int
+
+// logOut receives progress and diagnostic messages. It is switched to stderr
+// in JSON mode so stdout carries nothing but the results document.
+var logOut io.Writer = os.Stdout
+
+// requestLog receives a line per request with -verbose and is nil otherwise.
+// It always writes to stderr, whatever the output format.
+var requestLog *log.Logger
+
+// headerFlags collects repeated -H "Name: value" flags.
+type headerFlags []string
+
+func (h *headerFlags) String() string {
+    return strings.Join(*h, ", ")
+}
+
+func (h *headerFlags) Set(value string) error {
+    if !strings.Contains(value, ":") {
+        return fmt.Errorf("expected \"Name: value\", got %q", value)
+    }
+    *h = append(*h, value)
+    return nil
+}
+
+var headerList headerFlags
+
+// envRef matches a ${VAR} reference to an environment variable.
+var envRef = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// The -server, -basic-auth and -bearer values with their ${VAR} references
+// expanded by setup. The flags keep the references, so the report and the
+// -verbose log show those rather than the secrets. envRedactor turns the
+// values from -server back into references, and is nil when it has none.
+var (
+    serverURL      string
+    basicAuthValue string
+    bearerValue    string
+    envRedactor    *strings.Replacer
+)
+
+// expandEnv replaces the ${VAR} references in s with the values of the
+// environment variables. Unlike os.ExpandEnv it leaves a bare $ alone, as
+// payloads often contain one, and it fails on an unset variable rather than
+// sending an empty credential.
+func expandEnv(s string) (string, error) {
+    var missing []string
+    expanded := envRef.ReplaceAllStringFunc(s, func(ref string) string {
+        name := ref[2 : len(ref)-1]
+        value, ok := os.LookupEnv(name)
+        if !ok {
+            missing = append(missing, name)
+        }
+        return value
+    })
+    if len(missing) > 0 {
+        return "", fmt.Errorf("%s not set", strings.Join(missing, ", "))
+    }
+    return expanded, nil
+}
+
+// cookieFlags collects repeated -cookie name=value flags.
+type cookieFlags []*http.Cookie
+
+func (c *cookieFlags) String() string {
+    var pairs []string
+    for _, cookie := range *c {
+        pairs = append(pairs, cookie.Name+"="+cookie.Value)
+    }
+    return strings.Join(pairs, ", ")
+}
+
+func (c *cookieFlags) Set(value string) error {
+    name, val, ok := strings.Cut(value, "=")
+    if !ok || name == "" {
+        return fmt.Errorf("expected name=value, got %q", value)
+    }
+    *c = append(*c, &http.Cookie{Name: name, Value: val, Path: "/"})
+    return nil
+}
+
+var seedCookies cookieFlags
+
+// captureFlags collects repeated -capture-header names in canonical form.
+type captureFlags []string
+
+func (c *captureFlags) String() string {
+    return strings.Join(*c, ", ")
+}
+
+func (c *captureFlags) Set(value string) error {
+    name := strings.TrimSpace(value)
+    if name == "" || strings.ContainsAny(name, ": ") {
+        return fmt.Errorf("expected a header name, got %q", value)
+    }
+    *c = append(*c, http.CanonicalHeaderKey(name))
+    return nil
+}
+
+var captureHeaders captureFlags
+
+// resolveFlags collects repeated -resolve host:port:ip flags, mapping each
+// host:port to the ip:port dialed in its place.
+type resolveFlags map[string]string
+
+func (r resolveFlags) String() string {
+    var pairs []string
+    for from, to := range r {
+        pairs = append(pairs, from+" -> "+to)
+    }
+    sort.Strings(pairs)
+    return strings.Join(pairs, ", ")
+}
+
+func (r resolveFlags) Set(value string) error {
+    parts := strings.SplitN(value, ":", 3)
+    if len(parts) != 3 || parts[0] == "" || parts[1] == "" {
+        return fmt.Errorf("expected host:port:ip, got %q", value)
+    }
+    ip := net.ParseIP(strings.Trim(parts[2], "[]"))
+    if ip == nil {
+        return fmt.Errorf("invalid IP address %q", parts[2])
+    }
+    r[net.JoinHostPort(parts[0], parts[1])] = net.JoinHostPort(ip.String(), parts[1])
+    return nil
+}
+
+var resolveOverrides = resolveFlags{}
+
+// dialer is used for every connection, with the keep-alive and timeout
+// settings of http.DefaultTransport.
+var dialer = &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}
+
+// dialContext connects to addr, or to the address -resolve pins it to.
+func dialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+    if pinned, ok := resolveOverrides[addr]; ok {
+        addr = pinned
+    }
+    return dialer.DialContext(ctx, network, addr)
+}
+
+// formFlags collects repeated -form field=value and -form-file field=@path
+// flags.
+type formFlags struct {
+    files  bool // entries name files to upload rather than plain values
+    values []string
+}
+
+func (f *formFlags) String() string {
+    return strings.Join(f.values, ", ")
+}
+
+func (f *formFlags) Set(value string) error {
+    field, val, ok := strings.Cut(value, "=")
+    if !ok || field == "" {
+        return fmt.Errorf("expected field=value, got %q", value)
+    }
+    if f.files && !strings.HasPrefix(val, "@") {
+        return fmt.Errorf("expected field=@path, got %q", value)
+    }
+    f.values = append(f.values, value)
+    return nil
+}
+
+var (
+    formValues = formFlags{}
+    formFiles  = formFlags{files: true}
+)
+
+// formFile is a -form-file upload, read once at startup.
+type formFile struct {
+    field, filename string
+    data            []byte
+}
+
+// uploads holds the contents of every -form-file.
+var uploads []formFile
+
+func init() {
+    flag.Var(&headerList, "H", "Header to include in the request as \"Name: value\", with ${VAR} filled in from the environment (repeatable, preferred over -headers)")
+    flag.Var(&captureHeaders, "capture-header", "Count the values of this response header, e.g. to check caching or trace headers under load (repeatable)")
+    flag.Var(&sourceIPs, "source-ips", "Comma-separated local addresses that the -client-count clients connect from in turn")
+    flag.Var(resolveOverrides, "resolve", "Connect to ip instead of resolving host, given as host:port:ip like curl --resolve (repeatable)")
+    flag.Var(&seedCookies, "cookie", "Cookie to send as name=value, e.g. for a pre-authenticated session (repeatable)")
+    flag.Var(&formValues, "form", "Send a multipart/form-data body with this field=value (repeatable)")
+    flag.Var(&formFiles, "form-file", "Upload a file in a multipart/form-data body as field=@path (repeatable)")
+}
+
+// client is shared by all requests and is configured from the flags in main().
+var client *http.Client
+
+// targetURLs are the URLs requests are sent to, either -server alone or the
+// contents of -urls-file. urlCounter drives round-robin selection.
+var (
+    targetURLs []string
+    urlCounter uint64
+)
+
+// requestHeaders holds the headers from -headers and -H, applied to every
+// request.
+var requestHeaders http.Header
+
+// payloadBytes holds the request body, loaded once at startup from either
+// -payload or -payload-file so every request can reuse it.
+var payloadBytes []byte
+
+// Per-request templates compiled, with -template, from URLs and a payload
+// containing "{{". urlTemplates is keyed by the raw target URL and payloadTemplate is nil
+// when the payload is static. requestSeq numbers the rendered requests.
+var (
+    urlTemplates    map[string]*template.Template
+    payloadTemplate *template.Template
+    requestSeq      uint64
+)
+
+// methodChoice is one entry of -method-weights. A choice with a nil payload
+// sends the -payload or -payload-file body; sent counts its measured
+// requests and is updated atomically.
+type methodChoice struct {
+    method   string
+    weight   int
+    payload  []byte
+    template *template.Template // set when payload contains "{{"
+    sent     int64
+}
+
+// methodMix holds the -method-weights choices, and methodTotal the sum of
+// their weights. It is empty when every request uses -method.
+var (
+    methodMix   []methodChoice
+    methodTotal int
+)
+
+// requestVars are the values available to URL and payload templates.
+type requestVars struct {
+    Seq  uint64            // 1 for the first request, incrementing across all workers
+    Rand int64             // a random non-negative number, different for every request
+    Vars map[string]string // values captured by earlier steps of a -script journey
+}
+
+// expectBody is the compiled -expect-body-regex, or nil when response bodies
+// are not checked.
+var expectBody *regexp.Regexp
+
+// Request outcome counters, updated atomically by the benchmark workers.
+// A request is successful when it completes with a 2xx or 3xx status, or
+// with the -expect-status code when one is given; transport errors and
+// 4xx/5xx responses are counted as failures, with requests that exceeded
+// -timeout or failed -expect-status/-expect-body-regex validation also
+// tallied separately.
+var (
+    successfulRequests int64
+    failedRequests     int64
+    timeoutRequests    int64
+    validationFailures int64
+    connectFailures    int64    // connections a -protocol ws worker could not open
+    truncatedResponses int64    // responses whose body ran past -body-limit
+    encodedResponses   int64    // responses with a gzip or deflate Content-Encoding
+    encodedBytes       int64    // wire size of the compressed responses' bodies
+    decodedBytes       int64    // decoded size of the compressed responses' bodies
+    redirects          int64    // responses that were, or would have been, redirected
+    statusClasses      [6]int64 // indexed by StatusCode/100
+    tlsVersions        [5]int64 // indexed by Version-tls.VersionSSL30
+    protocols          [len(protocolNames)]int64
+    reusedConnections  int64
+    newConnections     int64
+)
+
+// protocolNames are the response protocols counted in protocols.
+var protocolNames = [...]string{"HTTP/1.0", "HTTP/1.1", "HTTP/2.0", "HTTP/3.0"}
+
+// Network byte counters covering request and response bodies.
+var (
+    bytesSent     int64
+    bytesReceived int64
 )
 
 func main() {
+    // Deferred first so that it runs last, after main's other deferred calls
+    defer func() {
+        if exitCode != 0 {
+            os.Exit(exitCode)
+        }
+    }()
+
     flag.Parse()
+    recordCommandLine()
+
+    if *configFile != "" {
+        if err := loadConfig(*configFile); err != nil {
+            fmt.Println("Error loading config:", err)
+            return
+        }
+    }
+
+    if *analyzeFile != "" {
+        analyzeRaw(*analyzeFile)
+        os.Exit(exitCode)
+    }
+
+    if *compare != "" {
+        oldFile, newFile, ok := strings.Cut(*compare, ",")
+        if !ok {
+            fmt.Println("Please specify -compare as old.json,new.json")
+            os.Exit(2)
+        }
+        os.Exit(compareRuns(oldFile, newFile, *threshold))
+    }
+
+    if *selfTest {
+        os.Exit(runSelfTest())
+    }
+
+    showProgress = isTerminal(os.Stdout)
+
+    runner := &Runner{}
+    if err := runner.prepare(); err != nil {
+        fmt.Println(err)
+        if errors.Is(err, errNoRunLength) {
+            flag.Usage()
+            os.Exit(2)
+        }
+        return
+    }
+
+    if *dryRun {
+        if *protocol != "http" {
+            fmt.Println("-dry-run is only supported with -protocol http")
+            return
+        }
+        var req *http.Request
+        var err error
+        if len(scriptSteps) > 0 {
+            req, err = newScriptRun().request(context.Background(), sharedRand)
+        } else {
+            req, err = createRequest(context.Background(), targetURLs[0], sharedRand)
+        }
+        if err != nil {
+            fmt.Println("Error creating request:", err)
+            return
+        }
+        // A -stream-size body is left out rather than generated in full
+        dump, err := httputil.DumpRequestOut(req, *streamSize == 0)
+        if err != nil {
+            fmt.Println("Error dumping request:", err)
+            return
+        }
+        os.Stdout.Write(dump)
+        return
+    }
+
+    if *metricsPort > 0 {
+        if err := serveMetrics(*metricsPort); err != nil {
+            fmt.Println("Error serving metrics:", err)
+            return
+        }
+    }
+
+    // Ctrl-C or SIGTERM cancels the run early; workers finish their current
+    // request and the partial results are reported as usual. A second signal
+    // falls through to the default handler and kills the process.
+    ctx, cancel := context.WithCancel(context.Background())
+    defer cancel()
+    sigs := make(chan os.Signal, 1)
+    signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+    go func() {
+        select {
+        case <-sigs:
+            signal.Stop(sigs)
+            atomic.StoreInt32(&interrupted, 1)
+            fmt.Fprintln(logOut, "\nInterrupted, finishing in-flight requests...")
+            cancel()
+        case <-ctx.Done():
+        }
+    }()
+
+    if *failFast || *waitForSrv > 0 {
+        if err := waitForServer(ctx); err != nil {
+            fmt.Println("Error reaching server:", err)
+            exitCode = 1
+            return
+        }
+    }
+
+    if *findKnee {
+        runKneeSearch(ctx, runner)
+    } else if *repeat > 1 {
+        runRepeated(ctx, runner)
+    } else {
+        result, err := runner.run(ctx)
+        switch {
+        case errors.Is(err, errNoResults):
+            reportNoResults()
+        case err != nil:
+            fmt.Fprintln(logOut, "Error:", err)
+            exitCode = 1
+        default:
+            reportResults(result, runner.samples, runner.responseTimes)
+        }
+    }
+}
+
+// errNoRunLength is returned by setup when -requests or -duration is
+// negative. A -duration of 0 without -requests runs until interrupted.
+var errNoRunLength = errors.New("Please specify a positive -requests count, or a -duration of 0 (run until interrupted) or more")
+
+// setup validates the flags and prepares the state shared by every request:
+// the client, target URLs, headers, payload and method mix. The error text is
+// what the command prints.
+func setup() error {
+    // ${VAR} references are expanded here rather than by the shell, so that
+    // secrets stay out of shell history and process listings
+    var envErr error
+    expand := func(s string) string {
+        expanded, err := expandEnv(s)
+        if err != nil && envErr == nil {
+            envErr = fmt.Errorf("Error expanding environment variables: %v", err)
+        }
+        return expanded
+    }
+    serverURL, basicAuthValue, bearerValue = expand(*server), expand(*basicAuth), expand(*bearerToken)
+    payloadText := expand(*payload)
+    if envErr != nil {
+        return envErr
+    }
+    var refs []string
+    for _, ref := range envRef.FindAllString(*server, -1) {
+        if value := os.Getenv(ref[2 : len(ref)-1]); value != "" {
+            refs = append(refs, value, ref)
+        }
+    }
+    if len(refs) > 0 {
+        envRedactor = strings.NewReplacer(refs...)
+    }
+
+    // Error handling for missing server flag
+    if *server == "" && *urlsFile == "" && *script == "" {
+        return errors.New("Please specify the server URL using the -server flag")
+    }
+    if *mode != "steady" && *mode != "burst" {
+        return fmt.Errorf("Invalid -mode (expected steady or burst): %v", *mode)
+    }
+    if *protocol != "http" && *protocol != "grpc" && *protocol != "ws" && *protocol != "tcp" {
+        return fmt.Errorf("Invalid -protocol (expected http, grpc, ws or tcp): %v", *protocol)
+    }
+    if *protocol == "grpc" && (*grpcMethod == "" || *urlsFile != "") {
+        return errors.New("Please specify -grpc-method and a host:port -server for grpc mode")
+    }
+    if *protocol == "tcp" && (*urlsFile != "" || !checkTCPAddr(strings.TrimPrefix(serverURL, "tcp://"))) {
+        return errors.New("Please specify a host:port -server for tcp mode")
+    }
+    if *urlOrder != "roundrobin" && *urlOrder != "random" {
+        return fmt.Errorf("Invalid -url-order (expected roundrobin or random): %v", *urlOrder)
+    }
+
+    initSeed()
+
+    if *script != "" {
+        if err := checkScript(); err != nil {
+            return err
+        }
+        steps, err := loadScript(*script)
+        if err != nil {
+            return fmt.Errorf("Error reading script: %v", err)
+        }
+        scriptSteps = steps
+        targetURLs = scriptURLs()
+    } else if *urlsFile != "" {
+        urls, err := readURLs(*urlsFile)
+        if err != nil {
+            return fmt.Errorf("Error reading URLs file: %v", err)
+        }
+        targetURLs = urls
+    } else {
+        targetURLs = []string{serverURL}
+    }
+    if *totalRequests < 0 || *duration < 0 {
+        return errNoRunLength
+    }
+
+    if *waitForSrv < 0 {
+        return fmt.Errorf("Invalid -wait-for-server (expected 0 or more): %v", *waitForSrv)
+    }
+    if *warmupReqs < 0 {
+        return fmt.Errorf("Invalid -warmup-requests (expected 0 or more): %v", *warmupReqs)
+    }
+    if *warmupReqs > 0 && (*mode != "steady" || *arrivalRate > 0) {
+        return errors.New("-warmup-requests counts the requests of each worker and cannot be used with -mode burst or -arrival-rate")
+    }
+
+    if *bins < 1 {
+        return fmt.Errorf("Invalid -bins (expected 1 or more): %v", *bins)
+    }
+    if *targetLatency < 0 {
+        return fmt.Errorf("Invalid -target-latency (expected 0 or more): %v", *targetLatency)
+    }
+    if *bootstrap < 0 {
+        return fmt.Errorf("Invalid -bootstrap (expected 0 or more): %v", *bootstrap)
+    }
+    if *confidence <= 0 || *confidence >= 100 {
+        return fmt.Errorf("Invalid -confidence (expected between 0 and 100): %v", *confidence)
+    }
+    if *repeat < 1 {
+        return fmt.Errorf("Invalid -repeat (expected 1 or more): %v", *repeat)
+    }
+    if *repeat > 1 && *totalRequests == 0 && *duration == 0 {
+        return errors.New("-repeat needs runs that end on their own: set -requests or a non-zero -duration")
+    }
+    if *cooldown < 0 {
+        return fmt.Errorf("Invalid -cooldown (expected 0 or more): %v", *cooldown)
+    }
+    if *metricsPort < 0 || *metricsPort > 65535 {
+        return fmt.Errorf("Invalid -metrics-port (expected 0-65535): %v", *metricsPort)
+    }
+    if *repeat > 1 && (*htmlFile != "" || *timeline || *slaP99 > 0 || *slaErrorRate != "") {
+        return errors.New("-repeat reports the spread across runs and cannot be used with -html, -timeline or -sla-*")
+    }
+    if *findKnee {
+        switch {
+        case *repeat > 1 || *htmlFile != "" || *timeline || *slaP99 > 0 || *slaErrorRate != "":
+            return errors.New("-find-knee reports the sweep across concurrency levels and cannot be used with -repeat, -html, -timeline or -sla-*")
+        case *mode != "steady" || *arrivalRate > 0 || *rateLimit > 0 || *autoStop:
+            return errors.New("-find-knee varies the number of workers and cannot be used with -mode burst, -arrival-rate, -rate or -auto-stop")
+        case *kneeStep <= 0:
+            return fmt.Errorf("Invalid -knee-step (expected more than 0): %v", *kneeStep)
+        case *kneeGain <= 0:
+            return fmt.Errorf("Invalid -knee-gain (expected more than 0): %v", *kneeGain)
+        case *maxConcurrency < 1:
+            return fmt.Errorf("Invalid -max-concurrency (expected 1 or more): %v", *maxConcurrency)
+        }
+    }
+
+    if *slaErrorRate != "" {
+        rate, err := parsePercent(*slaErrorRate)
+        if err != nil {
+            return fmt.Errorf("Invalid -sla-error-rate: %v", err)
+        }
+        maxErrorRate = rate
+    }
+
+    if *outputDir != "" {
+        if err := os.MkdirAll(*outputDir, 0o755); err != nil {
+            return fmt.Errorf("Error creating output directory: %v", err)
+        }
+    }
+
+    switch *output {
+    case "text":
+    case "json":
+        logOut = os.Stderr
+    default:
+        return fmt.Errorf("Invalid -output format (expected text or json): %v", *output)
+    }
+    if *verbose || *verboseErrs {
+        requestLog = log.New(os.Stderr, "", log.LstdFlags|log.Lmicroseconds)
+    }
+
+    if *basicAuth != "" && *bearerToken != "" {
+        return errors.New("Please specify only one of -basic-auth and -bearer")
+    }
+    if *basicAuth != "" && !strings.Contains(basicAuthValue, ":") {
+        return errors.New("Invalid -basic-auth (expected user:pass)")
+    }
+    if *methodWeights != "" && *protocol != "http" {
+        return errors.New("-method-weights is only supported with -protocol http")
+    }
+    if *forceHTTP2 && *http2Only {
+        return errors.New("Please specify only one of -http2 and -http2-only")
+    }
+    if *proxyURL != "" && *http2Only {
+        return errors.New("-proxy cannot be used with -http2-only")
+    }
+    if *thinkTime < 0 || *thinkJitter < 0 {
+        return errors.New("-think-time and -think-jitter cannot be negative")
+    }
+    if *arrivalRate < 0 {
+        return fmt.Errorf("Invalid -arrival-rate (expected 0 or more): %v", *arrivalRate)
+    }
+    if *pipeline != 0 {
+        if err := checkPipeline(); err != nil {
+            return err
+        }
+    }
+    if *latencyWindow < 0 {
+        return fmt.Errorf("Invalid -window (expected 0 or more): %v", *latencyWindow)
+    }
+    if *maxRPS < 0 {
+        return fmt.Errorf("Invalid -max-rps (expected 0 or more): %v", *maxRPS)
+    }
+    rpsCap = nil
+    if *maxRPS > 0 {
+        rpsCap = newTokenBucket(*maxRPS)
+    }
+    if *autoStop {
+        switch {
+        case *totalRequests > 0 || *mode != "steady":
+            return errors.New("-auto-stop caps the run at -duration and cannot be used with -requests or -mode burst")
+        case *stabilityThreshold <= 0:
+            return fmt.Errorf("Invalid -stability-threshold (expected more than 0): %v", *stabilityThreshold)
+        case *stabilityWindow <= 0:
+            return fmt.Errorf("Invalid -stability-window (expected more than 0): %v", *stabilityWindow)
+        case *stabilityWindows < 1:
+            return fmt.Errorf("Invalid -stability-windows (expected 1 or more): %v", *stabilityWindows)
+        }
+    }
+    if *arrivalRate > 0 {
+        switch {
+        case *maxInflight < 1:
+            return fmt.Errorf("Invalid -max-inflight (expected 1 or more): %v", *maxInflight)
+        case *protocol != "http":
+            return errors.New("-arrival-rate is only supported with -protocol http")
+        case *mode != "steady":
+            return errors.New("-arrival-rate cannot be used with -mode burst")
+        case *rateLimit > 0:
+            return errors.New("Please specify only one of -rate and -arrival-rate")
+        case *rampUp > 0 || *thinkTime > 0 || *thinkJitter > 0:
+            return errors.New("-ramp-up, -think-time and -think-jitter apply to workers and cannot be used with -arrival-rate")
+        }
+    }
+    if *maxErrors < 0 {
+        return fmt.Errorf("Invalid -max-errors (expected 0 or more): %v", *maxErrors)
+    }
+    if *bodyLimit < 0 {
+        return fmt.Errorf("Invalid -body-limit (expected 0 or more): %v", *bodyLimit)
+    }
+    if *connections < 0 {
+        return fmt.Errorf("Invalid -connections (expected 0 or more): %v", *connections)
+    }
+    if *connections > 0 && *http2Only {
+        return errors.New("-connections cannot be used with -http2-only")
+    }
+    if !*keepAlive && *http2Only {
+        return errors.New("-keepalive=false cannot be used with -http2-only")
+    }
+    transport, err := buildTransport(dialContext)
+    if err != nil {
+        return fmt.Errorf("Error configuring transport: %v", err)
+    }
+    client = &http.Client{Timeout: *timeout, Transport: transport}
+    if !*followRedirs {
+        client.CheckRedirect = func(*http.Request, []*http.Request) error {
+            return http.ErrUseLastResponse
+        }
+    }
+    if err := checkClients(); err != nil {
+        return err
+    }
+    if *clientCount > 0 {
+        clients, err := newSimClients(*clientCount)
+        if err != nil {
+            return fmt.Errorf("Error configuring transport: %v", err)
+        }
+        simClients = clients
+    }
+    retainSamples = needSamples()
+
+    // Header values are expanded once split, so that a secret containing a
+    // comma or = can't split the header
+    requestHeaders = make(http.Header)
+    for key, value := range parseHeaders(*headers) {
+        requestHeaders.Set(key, expand(value))
+    }
+    for _, h := range headerList {
+        key, value, _ := strings.Cut(h, ":")
+        requestHeaders.Add(strings.TrimSpace(key), expand(strings.TrimSpace(value)))
+    }
+    if envErr != nil {
+        return envErr
+    }
+
+    if *expectRegex != "" {
+        re, err := regexp.Compile(*expectRegex)
+        if err != nil {
+            return fmt.Errorf("Invalid -expect-body-regex: %v", err)
+        }
+        expectBody = re
+    }
+
+    payloadBytes = []byte(payloadText)
+    if *payloadFile != "" {
+        data, err := os.ReadFile(*payloadFile)
+        if err != nil {
+            return fmt.Errorf("Error reading payload file: %v", err)
+        }
+        payloadBytes = data
+    }
+    if *hashBodies && *protocol != "http" {
+        return errors.New("-hash-bodies is only supported with -protocol http")
+    }
+    if *payloadDir != "" {
+        switch {
+        case len(payloadBytes) > 0:
+            return errors.New("Please specify either -payload-dir or -payload/-payload-file, not both")
+        case *protocol != "http":
+            return errors.New("-payload-dir is only supported with -protocol http")
+        }
+        payloads, err := loadPayloadDir(*payloadDir)
+        if err != nil {
+            return fmt.Errorf("Error reading payload dir: %v", err)
+        }
+        dirPayloads = payloads
+    }
+
+    if *streamSize < 0 {
+        return fmt.Errorf("Invalid -stream-size (expected 0 or more): %v", *streamSize)
+    }
+    if *streamSize > 0 && (len(payloadBytes) > 0 || len(dirPayloads) > 0 || len(formValues.values) > 0 || len(formFiles.values) > 0 || *methodWeights != "") {
+        return errors.New("-stream-size generates the body and cannot be used with a payload, -form/-form-file or -method-weights")
+    }
+    if *streamSize > 0 && *protocol != "http" {
+        return errors.New("-stream-size is only supported with -protocol http")
+    }
+    if *streamSize > 0 && bodylessMethod(*method) {
+        return fmt.Errorf("-stream-size sends a request body; please specify a -method that takes one, such as POST (got %v)", *method)
+    }
+
+    if *sign != "" {
+        switch {
+        case *protocol != "http":
+            return errors.New("-sign is only supported with -protocol http")
+        case *streamSize > 0:
+            return errors.New("-sign needs the whole body and cannot be used with -stream-size")
+        case *sign == "aws-sigv4" && (*basicAuth != "" || *bearerToken != ""):
+            return errors.New("-sign aws-sigv4 sets the Authorization header and cannot be used with -basic-auth or -bearer")
+        }
+        signer, err := newSigner(*sign)
+        if err != nil {
+            return fmt.Errorf("Invalid -sign: %v", err)
+        }
+        signRequest = signer
+    }
+
+    if len(formValues.values) > 0 || len(formFiles.values) > 0 {
+        if len(payloadBytes) > 0 || len(dirPayloads) > 0 {
+            return errors.New("Please specify either -form/-form-file or a payload, not both")
+        }
+        if *methodWeights == "" && bodylessMethod(*method) {
+            return fmt.Errorf("-form/-form-file sends a multipart body; please specify a -method that takes one, such as POST (got %v)", *method)
+        }
+        for _, value := range formFiles.values {
+            field, path, _ := strings.Cut(value, "=@")
+            data, err := os.ReadFile(path)
+            if err != nil {
+                return fmt.Errorf("Error reading form file: %v", err)
+            }
+            uploads = append(uploads, formFile{field: field, filename: filepath.Base(path), data: data})
+        }
+    }
+
+    if *useTemplates {
+        if err := compileTemplates(); err != nil {
+            return fmt.Errorf("Invalid request template: %v", err)
+        }
+    }
+
+    if *methodWeights != "" {
+        choices, err := parseMethodWeights(*methodWeights)
+        if err != nil {
+            return fmt.Errorf("Invalid -method-weights: %v", err)
+        }
+        for _, choice := range choices {
+            if choice.payload != nil && (len(formValues.values) > 0 || len(formFiles.values) > 0) {
+                return errors.New("Please specify either -form/-form-file or -method-weights payloads, not both")
+            }
+            methodTotal += choice.weight
+        }
+        methodMix = choices
+    }
+
+    switch *protocol {
+    case "grpc":
+        call, err := newGRPCCall(serverURL, *grpcMethod)
+        if err != nil {
+            return fmt.Errorf("Error setting up gRPC call: %v", err)
+        }
+        protocolOpener = func(context.Context) (callFunc, func(), error) {
+            return call, func() {}, nil
+        }
+    case "ws":
+        protocolOpener = newWebSocketOpener(serverURL)
+    case "tcp":
+        protocolOpener = newTCPOpener(strings.TrimPrefix(serverURL, "tcp://"))
+    }
+    return nil
+}
+
+// benchmark runs the steady-mode load and returns its statistics, along with
+// the samples and sorted response times they were computed from.
+func benchmark(ctx context.Context) (Result, []sample, []time.Duration, error) {
+    // Pipelining is compared against the same workers without it, measured
+    // before the run proper
+    var baseline float64
+    if *pipeline > 0 {
+        fmt.Fprintf(logOut, "Measuring throughput without pipelining for %v\n", pipelineBaselineLength)
+        baseline = pipelineBaseline(ctx, *concurrency)
+    }
+
+    startTime := time.Now()
+
+    // Requests started before measureStart are part of the warmup: they are
+    // sent as usual but left out of every statistic
+    measureStart := startTime.Add(*warmup)
+
+    // Workers share a single stop signal that fires once the warmup and
+    // duration elapse, or once the last request has been sent in -requests
+    // mode. With a -duration of 0 only an interrupt fires it.
+    var cancel context.CancelFunc
+    if *totalRequests > 0 || *duration == 0 {
+        ctx, cancel = context.WithCancel(ctx)
+    } else {
+        ctx, cancel = context.WithTimeout(ctx, *warmup+*duration)
+    }
+    defer cancel()
+
+    switch {
+    case *arrivalRate > 0 && *totalRequests > 0:
+        fmt.Fprintf(logOut, "Starting %d requests arriving at %.2f/second, at most %d in flight\n", *totalRequests, *arrivalRate, *maxInflight)
+    case *arrivalRate > 0:
+        fmt.Fprintf(logOut, "Starting requests arriving at %.2f/second %s, at most %d in flight\n", *arrivalRate, runLength(), *maxInflight)
+    case *totalRequests > 0:
+        fmt.Fprintf(logOut, "Starting %d workers for %d requests\n", *concurrency, *totalRequests)
+    default:
+        fmt.Fprintf(logOut, "Starting %d workers %s\n", *concurrency, runLength())
+    }
+    fmt.Fprintf(logOut, "Random seed %d (replay with -seed %d)\n", runSeed, runSeed)
+    logRateCap()
+    if *warmup > 0 {
+        fmt.Fprintf(logOut, "Warming up for %v before recording\n", *warmup)
+    }
+    if *warmupReqs > 0 {
+        fmt.Fprintf(logOut, "Each worker sends %d warmup requests before recording\n", *warmupReqs)
+    }
+    if len(scriptSteps) > 0 {
+        fmt.Fprintf(logOut, "Each worker runs the %d steps of %s in a loop\n", len(scriptSteps), *script)
+    } else if len(targetURLs) > 1 {
+        fmt.Fprintf(logOut, "Spreading requests across %d URLs (%s)\n", len(targetURLs), *urlOrder)
+    }
+    if *connections > 0 {
+        fmt.Fprintf(logOut, "Limiting to %d connections per host\n", *connections)
+    }
+    if !*keepAlive {
+        fmt.Fprintln(logOut, "Keep-alive disabled: opening a new connection for every request")
+    }
+    if *thinkTime > 0 || *thinkJitter > 0 {
+        fmt.Fprintf(logOut, "Workers pause %v (plus up to %v) between requests\n", *thinkTime, *thinkJitter)
+    }
+    if *rampUp > 0 {
+        fmt.Fprintf(logOut, "Ramping up from 1 to %d workers over %v\n", *concurrency, *rampUp)
+    }
+    if *autoStop {
+        limit := "after at most " + duration.String()
+        if *duration == 0 {
+            limit = "or when interrupted"
+        }
+        fmt.Fprintf(logOut, "Stopping once the p99 of %v windows changes by less than %g%% %d times in a row, %s\n",
+            *stabilityWindow, *stabilityThreshold, *stabilityWindows, limit)
+        go stopWhenStable(ctx, cancel, measureStart)
+    }
+
+    pool := &workerPool{
+        workers:      *concurrency,
+        rampUp:       *rampUp,
+        measureStart: measureStart,
+        warmupReqs:   *warmupReqs,
+        maxRequests:  *totalRequests,
+        drainTimeout: *drainTimeout,
+        open:         protocolOpener,
+        arrivalRate:  *arrivalRate,
+        maxInflight:  *maxInflight,
+        pipeline:     *pipeline,
+    }
+    if *pipeline > 0 {
+        fmt.Fprintf(logOut, "Pipelining up to %d requests at a time on each connection\n", *pipeline)
+    }
+
+    // A single pacer is shared by all workers so the rate applies to the
+    // run as a whole rather than to each worker
+    if *rateLimit > 0 {
+        pool.pacer = newPacer(*rateLimit)
+        fmt.Fprintf(logOut, "Limiting to %.2f requests/second\n", *rateLimit)
+    }
+
+    configured := *concurrency
+    if *arrivalRate > 0 {
+        configured = *maxInflight
+    }
+    stream.reset(measureStart)
+    stopSampling := sampleInFlight(configured, measureStart)
+    stopProgress := startProgress(ctx)
+    allSamples, allPhases := pool.run(ctx)
+    measureEnd := time.Now()
+    stopProgress()
+    concurrencyStats := stopSampling()
+    saveSamples(allSamples)
+
+    // Rates are relative to the measurement window, which excludes the
+    // warmup. It is measured rather than taken from -duration, since a run
+    // can stop early and the requests in flight at the end still complete
+    // after it. With -warmup-requests it starts with the first request
+    // recorded.
+    window := measureEnd.Sub(measureStart)
+    if pool.measured != 0 {
+        if first := time.Unix(0, pool.measured); first.After(measureStart) {
+            window = measureEnd.Sub(first)
+        }
+    }
+
+    allResponseTimes := completedResponseTimes(allSamples)
+    if len(allResponseTimes) == 0 && stream.completed() == 0 {
+        return Result{}, allSamples, nil, errNoResults
+    }
+    result := summarize(allSamples, allResponseTimes, &allPhases, window)
+    result.Concurrency = concurrencyStats
+    if *pipeline > 0 {
+        result.Pipeline = pipelineStats(*pipeline, pool.pipeStats, result.Throughput, baseline)
+    }
+    saveRaw(result, allSamples, window)
+    saveHdr(measureEnd.Add(-window), measureEnd)
+    return result, allSamples, allResponseTimes, nil
+}
+
+// runLength describes how long a run bounded by -duration lasts, for the
+// start-up messages.
+func runLength() string {
+    if *duration == 0 {
+        return "until interrupted (Ctrl-C to stop)"
+    }
+    return "for " + duration.String()
+}
+
+// callFunc performs one request over a protocol other than HTTP, such as a
+// gRPC call, returning the number of bytes sent and received.
+type callFunc func(ctx context.Context) (sent, received int64, err error)
+
+// phaseTimingsKey is the context key under which a call finds the
+// phaseTimings to fill in, if it can time its phases.
+type phaseTimingsKey struct{}
+
+// callTimings returns the phaseTimings a callFunc should fill in for ctx, or
+// nil when the call isn't traced.
+func callTimings(ctx context.Context) *phaseTimings {
+    t, _ := ctx.Value(phaseTimingsKey{}).(*phaseTimings)
+    return t
+}
+
+// callOpener prepares the callFunc used by one worker, along with a function
+// releasing whatever it holds, such as the worker's connection.
+type callOpener func(ctx context.Context) (callFunc, func(), error)
+
+// protocolOpener is the callOpener for the selected -protocol, or nil for
+// HTTP.
+var protocolOpener callOpener
+
+// errStopWorker is returned by a callFunc that can make no further calls,
+// such as when its connection was lost and could not be reopened. The worker
+// stops without recording the call.
+var errStopWorker = errors.New("worker stopped")
+
+// errInvalidResponse is logged by -verbose for a response rejected by
+// -expect-status or -expect-body-regex.
+var errInvalidResponse = errors.New("response failed validation")
+
+// workerPool runs a fixed number of workers that send requests in a loop
+// until their context is done. Requests already in flight at that point are
+// given drainTimeout to complete and are recorded like any other; those still
+// running after it are aborted and left out of the statistics.
+type workerPool struct {
+    workers      int
+    rampUp       time.Duration // period over which worker starts are staggered
+    measureStart time.Time     // requests started earlier are warmup and not recorded
+    warmupReqs   int           // requests each worker sends before recording any
+    pacer        *pacer        // optional, shared by all workers
+    maxRequests  int64         // stop after this many measured requests (0 = no limit)
+    drainTimeout time.Duration // grace period for in-flight requests once ctx is done
+    open         callOpener    // sends requests through a callFunc instead of the HTTP client when set
+    arrivalRate  float64       // open model: mean Poisson arrivals per second, replacing the workers
+    maxInflight  int           // open model: most requests in flight at once
+    pipeline     int           // requests sent per batch on raw connections; 0 sends through the HTTP client
+
+    issued    int64
+    measured  int64             // with warmupReqs, when the first measured request was admitted, in Unix nanoseconds
+    pipeStats []pipeWorkerStats // per worker, once a pipelined run is over
+}
+
+// run starts the workers, waits for them to stop and returns everything they
+// recorded. Each worker records into its own slices and merges them in once it
+// stops, so the hot path takes no locks. A run that doesn't retain its
+// samples records them in stream a batch at a time instead.
+func (p *workerPool) run(ctx context.Context) ([]sample, phaseSamples) {
+    if p.open != nil {
+        return p.runCalls(ctx)
+    }
+    if p.arrivalRate > 0 {
+        return p.runArrivals(ctx)
+    }
+    if p.pipeline > 0 {
+        return p.runPipelined(ctx), phaseSamples{}
+    }
+
+    var wg sync.WaitGroup
+    var mu sync.Mutex
+    var allSamples []sample
+    var allPhases phaseSamples
+
+    requestCtx, abortRequests := p.requestContext(ctx)
+    defer abortRequests()
+
+    for i := 0; i < p.workers; i++ {
+        wg.Add(1)
+        go func(i int) {
+            defer wg.Done()
+
+            // Requests carry the worker's context, so an expired drain
+            // timeout aborts them on the wire instead of leaving them running
+            workerCtx, cancelWorker := context.WithCancel(requestCtx)
+            defer cancelWorker()
+            w := newHTTPWorker(workerCtx, newRand(int64(i)+1), clientFor(i))
+
+            defer func() {
+                mu.Lock()
+                allSamples = mergeSamples(allSamples, w.samples)
+                allPhases.merge(&w.phases)
+                mu.Unlock()
+            }()
+
+            // Stagger worker starts evenly across the ramp-up period
+            if p.rampUp > 0 {
+                select {
+                case <-time.After(p.rampUp * time.Duration(i) / time.Duration(p.workers)):
+                case <-ctx.Done():
+                    return
+                }
+            }
+
+            for n := 0; ctx.Err() == nil; n++ {
+                if n > 0 && !think(ctx, w.rng) {
+                    break
+                }
+                measuring := n >= p.warmupReqs && !time.Now().Before(p.measureStart)
+                due, ok := p.admit(ctx, measuring)
+                if !ok {
+                    break
+                }
+                if !w.send(due, measuring) {
+                    break
+                }
+            }
+        }(i)
+    }
+
+    wg.Wait()
+    return allSamples, allPhases
+}
+
+// runArrivals runs the open model: requests start at exponentially
+// distributed intervals averaging 1/arrivalRate, each in its own goroutine,
+// so a slow server builds up a queue of requests in flight rather than
+// slowing the arrivals down. Once maxInflight requests are in flight, new
+// arrivals wait for a free slot and the wait counts toward their response
+// time, as it would for a user.
+func (p *workerPool) runArrivals(ctx context.Context) ([]sample, phaseSamples) {
+    var wg sync.WaitGroup
+    var mu sync.Mutex
+    var allSamples []sample
+    var allPhases phaseSamples
+
+    requestCtx, abortRequests := p.requestContext(ctx)
+    defer abortRequests()
+
+    // Arrivals are drawn from one stream, which also seeds each request's
+    // own, so a replay sends the same requests at the same offsets
+    arrivals := newRand(0)
+    slots := make(chan struct{}, p.maxInflight)
+    next := time.Now()
+    for n := 0; ctx.Err() == nil; n++ {
+        next = next.Add(time.Duration(arrivals.ExpFloat64() / p.arrivalRate * float64(time.Second)))
+        if d := time.Until(next); d > 0 {
+            timer := time.NewTimer(d)
+            select {
+            case <-timer.C:
+            case <-ctx.Done():
+                timer.Stop()
+            }
+        }
+        if ctx.Err() != nil {
+            break
+        }
+        measuring := !next.Before(p.measureStart)
+        if _, ok := p.admit(ctx, measuring); !ok {
+            break
+        }
+        select {
+        case slots <- struct{}{}:
+        case <-ctx.Done():
+        }
+        if ctx.Err() != nil {
+            break
+        }
+
+        wg.Add(1)
+        go func(due time.Time, rng *rand.Rand, sim *simClient) {
+            defer wg.Done()
+            defer func() { <-slots }()
+            w := newHTTPWorker(requestCtx, rng, sim)
+            w.send(due, measuring)
+            // Arrivals each send one request, so rather than merging them
+            // one at a time they share the pool's buffer, which is recorded
+            // in stream a batch at a time
+            mu.Lock()
+            for _, s := range w.samples {
+                allSamples = keepSample(allSamples, s)
+            }
+            allPhases.gather(&w.phases)
+            mu.Unlock()
+        }(next, rand.New(rand.NewSource(arrivals.Int63())), clientFor(n))
+    }
+
+    wg.Wait()
+    if !retainSamples {
+        stream.add(allSamples)
+        allPhases.flush()
+        allSamples = nil
+    }
+    return allSamples, allPhases
+}
+
+// httpWorker sends HTTP requests on behalf of one worker of a pool, or one
+// arrival in the open model, and collects their samples and phase timings.
+type httpWorker struct {
+    ctx     context.Context // carried by requests; cancelled once the drain timeout expires
+    client  *http.Client
+    rng     *rand.Rand // draws the worker's URLs, methods and pauses
+    script  *scriptRun // the worker's journey with -script, or nil
+    sim     *simClient // the -client-count client the worker belongs to, or nil
+    samples []sample
+    phases  phaseSamples
+}
+
+func newHTTPWorker(ctx context.Context, rng *rand.Rand, sim *simClient) *httpWorker {
+    // With -cookies each worker acts as one user with its own session, and
+    // with -client-count it shares the session of its client
+    w := &httpWorker{ctx: ctx, client: client, rng: rng, sim: sim}
+    if *useCookies {
+        w.client = newSessionClient()
+    }
+    if sim != nil {
+        w.client = sim.client
+    }
+    if len(scriptSteps) > 0 {
+        w.script = newScriptRun()
+    }
+    return w
+}
+
+// clientID returns the id of the worker's -client-count client, or 0.
+func (w *httpWorker) clientID() int {
+    if w.sim == nil {
+        return 0
+    }
+    return w.sim.id
+}
+
+// send makes one request that was due at due, recording it when measuring.
+// It returns false when the request was aborted by the drain timeout, after
+// which no more should be sent.
+func (w *httpWorker) send(due time.Time, measuring bool) bool {
+    var req *http.Request
+    var err error
+    var step string
+    if w.script != nil {
+        step = w.script.step().name
+        req, err = w.script.request(w.ctx, w.rng)
+    } else {
+        req, err = createRequest(w.ctx, nextURL(w.rng), w.rng) // Use the customizable request function
+    }
+    if err != nil {
+        if w.script != nil {
+            w.script.restart()
+        }
+        if measuring {
+            countFailure()
+            countError("request build error")
+        }
+        return true
+    }
+    if measuring && len(methodMix) > 0 {
+        countMethod(req.Method)
+    }
+    var timings phaseTimings
+    req = req.WithContext(httptrace.WithClientTrace(req.Context(), newClientTrace(&timings)))
+    if measuring && req.Body != nil && req.Body != http.NoBody {
+        req.Body = countingReader{req.Body}
+    }
+
+    // Time the full round trip, including reading the body. The body must be
+    // drained before closing so the connection can be reused for the next
+    // request.
+    startTime := time.Now()
+    delay := sendDelay(due, startTime)
+    timings.start = startTime
+    atomic.AddInt64(&inFlight, 1)
+    resp, err := w.client.Do(req)
+    if err != nil {
+        atomic.AddInt64(&inFlight, -1)
+        if w.script != nil {
+            w.script.restart()
+        }
+        // A request aborted because it outlived the drain timeout says
+        // nothing about the server, so it is dropped rather than failed
+        if w.ctx.Err() != nil {
+            return false
+        }
+        if measuring {
+            responseTime := time.Since(startTime) + delay
+            recordFailure(err)
+            w.samples = keepSample(w.samples, sample{Start: startTime, Duration: responseTime, Delay: delay, Host: req.URL.Host, Step: step, Client: w.clientID(), Err: err})
+            logRequest(req.Method, req.URL.String(), 0, responseTime, err, true)
+        }
+        return true
+    }
+    // The body is only kept when it has to be matched against
+    // -expect-body-regex or a -script step. With -body-limit the clock stops once the limit has
+    // been read, and anything beyond it is drained untimed so the connection
+    // can still be reused. Compressed bodies are decoded here rather than by
+    // the transport so that wire.n is the size actually received.
+    wire := &byteCounter{r: resp.Body}
+    decoder, compressed, err := decodeBody(resp.Header.Get("Content-Encoding"), wire)
+    var body []byte
+    var decoded int64
+    var digest *bodyDigest
+    sink := io.Discard
+    if *hashBodies {
+        digest = newBodyDigest()
+        sink = digest
+    }
+    if err == nil {
+        var src io.Reader = decoder
+        if *bodyLimit > 0 {
+            src = io.LimitReader(decoder, *bodyLimit)
+        }
+        if expectBody != nil || w.script != nil {
+            body, err = io.ReadAll(src)
+            decoded = int64(len(body))
+            sink.Write(body)
+        } else {
+            decoded, err = io.Copy(sink, src)
+        }
+    }
+    responseTime := time.Since(startTime) + delay
+    var truncated bool
+    if *bodyLimit > 0 && err == nil {
+        rest, _ := io.Copy(sink, decoder)
+        truncated = rest > 0
+        decoded += rest
+    }
+    io.Copy(io.Discard, wire)
+    resp.Body.Close()
+    atomic.AddInt64(&inFlight, -1)
+    n := wire.n
+
+    // A -script journey moves on, or starts over, whether or not the step
+    // was measured
+    valid, statusChecked := err == nil && validResponse(resp.StatusCode, body), *expectStatus != 0
+    if w.script != nil {
+        statusChecked = statusChecked || w.script.step().expectStatus != 0
+        var done bool
+        valid, done = w.script.finish(valid, resp.StatusCode, resp.Header, body)
+        if done && measuring {
+            atomic.AddInt64(&journeysCompleted, 1)
+        }
+    }
+    if !measuring || (err != nil && w.ctx.Err() != nil) {
+        return true
+    }
+    if truncated {
+        atomic.AddInt64(&truncatedResponses, 1)
+    }
+    if compressed {
+        atomic.AddInt64(&encodedResponses, 1)
+        atomic.AddInt64(&encodedBytes, n)
+        atomic.AddInt64(&decodedBytes, decoded)
+    }
+    if timings.gotConn {
+        if timings.reused {
+            atomic.AddInt64(&reusedConnections, 1)
+        } else {
+            atomic.AddInt64(&newConnections, 1)
+            countRemote(timings.remote)
+            if timings.handshake {
+                countHandshake(timings.resumed)
+            }
+        }
+    }
+    atomic.AddInt64(&bytesReceived, n)
+    var ttfb time.Duration
+    if timings.TTFB > 0 {
+        ttfb = timings.TTFB + delay
+    }
+    s := sample{
+        Start:    startTime,
+        Duration: responseTime,
+        Delay:    delay,
+        Status:   resp.StatusCode,
+        TTFB:     ttfb,
+        Bytes:    n,
+        Host:     req.URL.Host,
+        Step:     step,
+        Client:   w.clientID(),
+        Reused:   timings.reused,
+        Err:      err,
+    }
+    if err != nil {
+        w.samples = keepSample(w.samples, s)
+        recordFailure(err)
+        logRequest(req.Method, req.URL.String(), resp.StatusCode, responseTime, err, true)
+        return true
+    }
+    recordProgress(responseTime)
+    w.phases.add(&timings)
+
+    if class := resp.StatusCode / 100; class > 0 && class < len(statusClasses) {
+        atomic.AddInt64(&statusClasses[class], 1)
+    }
+    if len(captureHeaders) > 0 {
+        captureHeaderValues(resp.Header)
+    }
+    if digest != nil {
+        recordBodyHash(digest)
+    }
+    // A request the client built to follow a redirect carries the redirect
+    // response, and with -follow-redirects=false the redirect itself is the
+    // response
+    if resp.Request.Response != nil || (resp.StatusCode/100 == 3 && resp.Header.Get("Location") != "") {
+        atomic.AddInt64(&redirects, 1)
+    }
+    if resp.TLS != nil {
+        if v := int(resp.TLS.Version) - tls.VersionSSL30; v >= 0 && v < len(tlsVersions) {
+            atomic.AddInt64(&tlsVersions[v], 1)
+        }
+    }
+    if idx := protocolIndex(resp.ProtoMajor, resp.ProtoMinor); idx >= 0 {
+        atomic.AddInt64(&protocols[idx], 1)
+    }
+    s.Failed = !countOutcome(req, resp.StatusCode, valid, statusChecked, responseTime)
+    w.samples = keepSample(w.samples, s)
+    return true
+}
+
+// countOutcome counts a response that was read in full as a success or a
+// failure: a failure when it did not pass the -expect-* or -script checks,
+// or when it has a 4xx or 5xx status that no check asked for. It returns
+// whether the response counted as a success.
+func countOutcome(req *http.Request, status int, valid, statusChecked bool, responseTime time.Duration) bool {
+    switch {
+    case !valid:
+        atomic.AddInt64(&validationFailures, 1)
+        countFailure()
+        logRequest(req.Method, req.URL.String(), status, responseTime, errInvalidResponse, true)
+    case statusChecked || status < 400:
+        atomic.AddInt64(&successfulRequests, 1)
+        logRequest(req.Method, req.URL.String(), status, responseTime, nil, false)
+        return true
+    default:
+        countFailure()
+        logRequest(req.Method, req.URL.String(), status, responseTime, nil, true)
+    }
+    return false
+}
+
+// logRequest writes a request's outcome to requestLog, if -verbose is set.
+// A status of 0 means no response was received. Successful requests are
+// skipped with -verbose-errors-only.
+func logRequest(method, target string, status int, duration time.Duration, err error, failed bool) {
+    if requestLog == nil || (*verboseErrs && !failed) {
+        return
+    }
+    if envRedactor != nil {
+        target = envRedactor.Replace(target)
+    }
+    line := method + " " + target
+    if status != 0 {
+        line += " " + strconv.Itoa(status)
+    }
+    line += " " + duration.Round(time.Microsecond).String()
+    if err != nil {
+        line += " error: " + err.Error()
+    }
+    requestLog.Println(line)
+}
+
+// requestContext returns the context requests are sent with. It outlives ctx
+// so that the end of the run stops new requests without cutting off the ones
+// in flight, and is cancelled once the drain timeout expires after that.
+func (p *workerPool) requestContext(ctx context.Context) (context.Context, context.CancelFunc) {
+    requestCtx, abortRequests := context.WithCancel(context.Background())
+    go func() {
+        select {
+        case <-ctx.Done():
+        case <-requestCtx.Done():
+            return
+        }
+        select {
+        case <-time.After(p.drainTimeout):
+            abortRequests()
+        case <-requestCtx.Done():
+        }
+    }()
+    return requestCtx, abortRequests
+}
+
+// admit blocks until the next request may be sent and reports whether the
+// worker should send it, or stop because the run is over. due is the time
+// the pacer scheduled the request for, or zero when the rate is unlimited.
+func (p *workerPool) admit(ctx context.Context, measuring bool) (due time.Time, ok bool) {
+    // Claim a slot before sending so exactly maxRequests are issued after
+    // the warmup
+    if measuring && p.maxRequests > 0 && atomic.AddInt64(&p.issued, 1) > p.maxRequests {
+        return time.Time{}, false
+    }
+    if measuring && p.warmupReqs > 0 {
+        atomic.CompareAndSwapInt64(&p.measured, 0, time.Now().UnixNano())
+    }
+    if p.pacer != nil {
+        var err error
+        if due, err = p.pacer.wait(ctx); err != nil {
+            return due, false
+        }
+    }
+    if rpsCap != nil && rpsCap.take(ctx) != nil {
+        return due, false
+    }
+    return due, true
+}
+
+// think pauses a worker between requests for -think-time plus a uniformly
+// random extra of up to -think-jitter drawn from rng, as a real user would.
+// It returns false without waiting out the pause if ctx is done first.
+func think(ctx context.Context, rng *rand.Rand) bool {
+    pause := *thinkTime
+    if *thinkJitter > 0 {
+        pause += time.Duration(rng.Int63n(int64(*thinkJitter) + 1))
+    }
+    if pause <= 0 {
+        return true
+    }
+    timer := time.NewTimer(pause)
+    defer timer.Stop()
+    select {
+    case <-timer.C:
+        return true
+    case <-ctx.Done():
+        return false
+    }
+}
+
+// pacer spreads requests evenly over time at a fixed rate. Each request is
+// due at a fixed point on the run's timeline rather than an interval after
+// the previous one, so a stalled server doesn't push the schedule back: the
+// requests that should have been sent meanwhile go out as soon as a worker
+// is free, and how late they were counts toward their response time. This
+// avoids coordinated omission, where the requests a stall delays are never
+// measured and the tail latency looks better than users experience it.
+type pacer struct {
+    start     time.Time
+    perSecond float64
+    next      int64
+}
+
+func newPacer(perSecond float64) *pacer {
+    return &pacer{start: time.Now(), perSecond: perSecond}
+}
+
+// wait blocks until the next request is due and returns the time it was
+// due, which is in the past when the workers are behind schedule.
+func (p *pacer) wait(ctx context.Context) (time.Time, error) {
+    n := atomic.AddInt64(&p.next, 1) - 1
+    due := p.start.Add(time.Duration(float64(n) / p.perSecond * float64(time.Second)))
+    if d := time.Until(due); d > 0 {
+        timer := time.NewTimer(d)
+        defer timer.Stop()
+        select {
+        case <-timer.C:
+        case <-ctx.Done():
+            return due, ctx.Err()
+        }
+    }
+    return due, nil
+}
+
+// rpsCap enforces -max-rps across every worker and pool of a run, or is nil
+// when there is no cap.
+var rpsCap *tokenBucket
+
+// tokenBucket limits requests to a rate. Unlike a pacer it never lets
+// requests catch up on time lost earlier: it holds a single token, so
+// requests are at least 1/rate apart however far behind they are.
+type tokenBucket struct {
+    mu       sync.Mutex
+    interval time.Duration // time for one token to accrue
+    next     time.Time     // when the next token is available
+}
+
+func newTokenBucket(perSecond float64) *tokenBucket {
+    return &tokenBucket{interval: time.Duration(float64(time.Second) / perSecond)}
+}
+
+// take blocks until a token is available and claims it. A request that
+// gives up waiting because ctx is done hands its token back, so the workers
+// of a finished burst don't hold up the next one.
+func (b *tokenBucket) take(ctx context.Context) error {
+    b.mu.Lock()
+    now := time.Now()
+    if b.next.Before(now) {
+        b.next = now
+    }
+    at := b.next
+    b.next = at.Add(b.interval)
+    b.mu.Unlock()
+
+    if d := at.Sub(now); d > 0 {
+        timer := time.NewTimer(d)
+        defer timer.Stop()
+        select {
+        case <-timer.C:
+        case <-ctx.Done():
+            b.mu.Lock()
+            b.next = b.next.Add(-b.interval)
+            b.mu.Unlock()
+            return ctx.Err()
+        }
+    }
+    return nil
+}
+
+// logRateCap reports the -max-rps cap, or warns when there is none and a
+// target is not on this machine, since nothing then stops the run from
+// overloading a shared server.
+func logRateCap() {
+    if *maxRPS > 0 {
+        fmt.Fprintf(logOut, "Capping at %.2f requests/second\n", *maxRPS)
+        return
+    }
+    for host := range targetHosts() {
+        if !isLocalHost(host) {
+            fmt.Fprintf(logOut, "WARNING: no -max-rps cap is set and %s is not a local host; the only limit on the load is how fast it can be sent\n", host)
+            return
+        }
+    }
+}
+
+// isLocalHost reports whether host, with or without a port, names this
+// machine.
+func isLocalHost(host string) bool {
+    if h, _, err := net.SplitHostPort(host); err == nil {
+        host = h
+    }
+    host = strings.Trim(host, "[]")
+    if host == "localhost" || strings.HasSuffix(host, ".localhost") {
+        return true
+    }
+    ip := net.ParseIP(host)
+    return ip != nil && ip.IsLoopback()
+}
+
+// sendDelay returns how long after its due time a request was sent, or 0
+// for a request that wasn't paced.
+func sendDelay(due, sent time.Time) time.Duration {
+    if due.IsZero() || sent.Before(due) {
+        return 0
+    }
+    return sent.Sub(due)
+}
+
+// runCalls is run for a pool with a callOpener. Each call is bounded by
+// -timeout and only records its duration, size and outcome, since there is
+// no HTTP response to inspect, along with any phases the call timed. A
+// worker whose callFunc can't be opened counts a connection failure and
+// stops.
+func (p *workerPool) runCalls(ctx context.Context) ([]sample, phaseSamples) {
+    var wg sync.WaitGroup
+    var mu sync.Mutex
+    var allSamples []sample
+    var allPhases phaseSamples
+
+    requestCtx, abortRequests := p.requestContext(ctx)
+    defer abortRequests()
+
+    for i := 0; i < p.workers; i++ {
+        wg.Add(1)
+        go func(i int) {
+            defer wg.Done()
+            var samples []sample
+            var phases phaseSamples
+            defer func() {
+                mu.Lock()
+                allSamples = mergeSamples(allSamples, samples)
+                allPhases.merge(&phases)
+                mu.Unlock()
+            }()
+
+            call, closeCall, err := p.open(requestCtx)
+            if err != nil {
+                atomic.AddInt64(&connectFailures, 1)
+                return
+            }
+            defer closeCall()
+            rng := newRand(int64(i) + 1)
+
+            if p.rampUp > 0 {
+                select {
+                case <-time.After(p.rampUp * time.Duration(i) / time.Duration(p.workers)):
+                case <-ctx.Done():
+                    return
+                }
+            }
+
+            for n := 0; ctx.Err() == nil; n++ {
+                if n > 0 && !think(ctx, rng) {
+                    break
+                }
+                measuring := n >= p.warmupReqs && !time.Now().Before(p.measureStart)
+                due, ok := p.admit(ctx, measuring)
+                if !ok {
+                    break
+                }
+
+                var timings phaseTimings
+                callCtx, cancel := context.WithTimeout(context.WithValue(requestCtx, phaseTimingsKey{}, &timings), *timeout)
+                startTime := time.Now()
+                delay := sendDelay(due, startTime)
+                atomic.AddInt64(&inFlight, 1)
+                sent, received, err := call(callCtx)
+                responseTime := time.Since(startTime) + delay
+                atomic.AddInt64(&inFlight, -1)
+                timedOut := callCtx.Err() == context.DeadlineExceeded
+                cancel()
+
+                if errors.Is(err, errStopWorker) || (err != nil && requestCtx.Err() != nil) {
+                    break
+                }
+                if !measuring {
+                    continue
+                }
+                atomic.AddInt64(&bytesSent, sent)
+                atomic.AddInt64(&bytesReceived, received)
+                var ttfb time.Duration
+                if timings.TTFB > 0 {
+                    ttfb = timings.TTFB + delay
+                }
+                samples = keepSample(samples, sample{Start: startTime, Duration: responseTime, Delay: delay, TTFB: ttfb, Bytes: received, Err: err})
+                logRequest(strings.ToUpper(*protocol), *server, 0, responseTime, err, err != nil)
+                if err != nil {
+                    countFailure()
+                    if timedOut {
+                        atomic.AddInt64(&timeoutRequests, 1)
+                    }
+                    recordError(err)
+                    continue
+                }
+                recordProgress(responseTime)
+                phases.add(&timings)
+                atomic.AddInt64(&successfulRequests, 1)
+            }
+        }(i)
+    }
+
+    wg.Wait()
+    return allSamples, allPhases
+}
+
+// saveSamples writes the per-request samples to -csv, if set.
+func saveSamples(allSamples []sample) {
+    if *csvFile == "" {
+        return
+    }
+    filename := artifactPath(*csvFile)
+    if err := writeCSV(allSamples, filename); err != nil {
+        fmt.Fprintln(logOut, "Error writing CSV:", err)
+        return
+    }
+    fmt.Fprintf(logOut, "Saved %d request samples to %s\n", len(allSamples), filename)
+}
+
+// completedResponseTimes returns the durations of every request that got a
+// complete response, whatever its status code, sorted in ascending order.
+func completedResponseTimes(allSamples []sample) []time.Duration {
+    var responseTimes []time.Duration
+    for _, s := range allSamples {
+        if s.Err == nil {
+            responseTimes = append(responseTimes, s.Duration)
+        }
+    }
+    sort.Slice(responseTimes, func(i, j int) bool {
+        return responseTimes[i] < responseTimes[j]
+    })
+    return responseTimes
+}
+
+// uncorrectedResponseTimes is like completedResponseTimes, but measures
+// each request from when it was actually sent rather than when it was due.
+func uncorrectedResponseTimes(allSamples []sample) []time.Duration {
+    var responseTimes []time.Duration
+    for _, s := range allSamples {
+        if s.Err == nil {
+            responseTimes = append(responseTimes, s.Duration-s.Delay)
+        }
+    }
+    sort.Slice(responseTimes, func(i, j int) bool {
+        return responseTimes[i] < responseTimes[j]
+    })
+    return responseTimes
+}
+
+// errNoResults is returned by a run in which no request completed, so there
+// are no response times to compute statistics from.
+var errNoResults = errors.New("no completed requests, cannot compute statistics")
+
+// reportNoResults explains why there are no statistics and marks the run as
+// failed.
+func reportNoResults() {
+    fmt.Fprintf(logOut, "\nNo completed requests, cannot compute statistics (%d failed)\n", atomic.LoadInt64(&failedRequests))
+    if n := atomic.LoadInt64(&connectFailures); n > 0 {
+        fmt.Fprintf(logOut, "%d connections could not be opened\n", n)
+    }
+    counts := errorCounts()
+    for _, kind := range keysByCount(counts) {
+        fmt.Fprintf(logOut, "%s: %d\n", kind, counts[kind])
+    }
+    exitCode = 1
+}
+
+// summarize computes the run statistics from the samples, their sorted
+// response times and the global counters. window is the length of the
+// measurement period.
+func summarize(allSamples []sample, allResponseTimes []time.Duration, allPhases *phaseSamples, window time.Duration) Result {
+    result := Result{
+        RampUp:             *rampUp,
+        Warmup:             *warmup,
+        WarmupRequests:     *warmupReqs,
+        Seed:               runSeed,
+        SuccessfulRequests: atomic.LoadInt64(&successfulRequests),
+        FailedRequests:     atomic.LoadInt64(&failedRequests),
+        Timeouts:           atomic.LoadInt64(&timeoutRequests),
+        ValidationFailures: atomic.LoadInt64(&validationFailures),
+        ConnectFailures:    atomic.LoadInt64(&connectFailures),
+        TruncatedResponses: atomic.LoadInt64(&truncatedResponses),
+        Errors:             errorCounts(),
+        StatusCodes:        make(map[string]int64),
+        BytesSent:          atomic.LoadInt64(&bytesSent),
+        BytesReceived:      atomic.LoadInt64(&bytesReceived),
+        EncodedResponses:   atomic.LoadInt64(&encodedResponses),
+        EncodedBytes:       atomic.LoadInt64(&encodedBytes),
+        DecodedBytes:       atomic.LoadInt64(&decodedBytes),
+        ResourceUsage:      resourceSamples(),
+        Phases:             allPhases.summarize(),
+        Interrupted:        atomic.LoadInt32(&interrupted) == 1,
+        MaxErrorsReached:   atomic.LoadInt32(&errorBudgetExceeded) == 1,
+        AutoStopped:        atomic.LoadInt32(&autoStopped) == 1,
+        ReusedConnections:  atomic.LoadInt64(&reusedConnections),
+        NewConnections:     atomic.LoadInt64(&newConnections),
+        RemoteAddrs:        remoteCounts(),
+        TLSSessions:        tlsSessionStats(),
+        Headers:            headerCounts(),
+        BodyHashes:         bodyHashStats(),
+        Journeys:           atomic.LoadInt64(&journeysCompleted),
+    }
+    result.ConnectionDrops = connectionDrops(result.Errors)
+    result.GCCycles, result.GCPauseTotal, result.GCPauseMax = gcSinceStart()
+    if conns := result.ReusedConnections + result.NewConnections; conns > 0 {
+        result.ReuseRate = float64(result.ReusedConnections) / float64(conns) * 100
+    }
+    if result.EncodedBytes > 0 {
+        result.CompressionRatio = float64(result.DecodedBytes) / float64(result.EncodedBytes)
+    }
+    result.SendRate = float64(result.BytesSent) / window.Seconds()
+    result.ReceiveRate = float64(result.BytesReceived) / window.Seconds()
+    result.TotalRequests = result.SuccessfulRequests + result.FailedRequests
+    if *rateLimit > 0 || *arrivalRate > 0 {
+        result.TargetRate = *rateLimit + *arrivalRate
+        result.AchievedRate = float64(result.TotalRequests) / window.Seconds()
+    }
+    var responses int64
+    for class := 1; class < len(statusClasses); class++ {
+        if count := atomic.LoadInt64(&statusClasses[class]); count > 0 {
+            result.StatusCodes[fmt.Sprintf("%dxx", class)] = count
+            responses += count
+        }
+    }
+    result.Redirects = atomic.LoadInt64(&redirects)
+    if responses > 0 {
+        result.RedirectRate = float64(result.Redirects) / float64(responses) * 100
+    }
+    for i := range methodMix {
+        if result.Methods == nil {
+            result.Methods = make(map[string]int64)
+        }
+        result.Methods[methodMix[i].method] += atomic.LoadInt64(&methodMix[i].sent)
+    }
+    result.PayloadFiles, result.PayloadsSent = len(dirPayloads), payloadsSent()
+    for idx, name := range protocolNames {
+        if count := atomic.LoadInt64(&protocols[idx]); count > 0 {
+            if result.Protocols == nil {
+                result.Protocols = make(map[string]int64)
+            }
+            result.Protocols[name] = count
+        }
+    }
+    for v := range tlsVersions {
+        if count := atomic.LoadInt64(&tlsVersions[v]); count > 0 {
+            if result.TLSVersions == nil {
+                result.TLSVersions = make(map[string]int64)
+            }
+            result.TLSVersions[tlsVersionName(uint16(v+tls.VersionSSL30))] = count
+        }
+    }
+
+    if retainSamples {
+        summarizeSamples(&result, allSamples, allResponseTimes, window)
+    } else {
+        summarizeStream(&result, window)
+    }
+    return result
+}
+
+// summarizeSamples fills in the statistics of r that are derived from the
+// samples alone, so that -analyze can recompute them from a -raw-out file.
+func summarizeSamples(r *Result, allSamples []sample, allResponseTimes []time.Duration, window time.Duration) {
+    // Calculate the mean and standard deviation in a single pass using
+    // Welford's method, which stays accurate without summing squares of
+    // large nanosecond values
+    var mean, m2 float64
+    for i, rt := range allResponseTimes {
+        x := float64(rt)
+        delta := x - mean
+        mean += delta / float64(i+1)
+        m2 += delta * (x - mean)
+    }
+
+    r.Mean = time.Duration(mean)
+    r.StdDev = time.Duration(math.Sqrt(m2 / float64(len(allResponseTimes))))
+    r.Min = allResponseTimes[0]
+    r.Max = allResponseTimes[len(allResponseTimes)-1]
+    r.Median = computePercentile(allResponseTimes, 50)
+    r.P75 = computePercentile(allResponseTimes, 75)
+    r.P90 = computePercentile(allResponseTimes, 90)
+    r.P95 = computePercentile(allResponseTimes, 95)
+    r.P99 = computePercentile(allResponseTimes, 99)
+    r.P999 = computePercentile(allResponseTimes, 99.9)
+    r.Throughput = float64(len(allResponseTimes)) / window.Seconds() // Use total request count
+    r.StatusLatency = statusLatencies(allSamples)
+    r.Hosts = hostStats(allSamples)
+    r.Steps = stepStats(allSamples)
+    r.Clients = clientStats(allSamples)
+    r.ThroughputSeries = throughputSeries(allSamples)
+    if r.TargetRate > 0 {
+        r.UncorrectedP99 = computePercentile(uncorrectedResponseTimes(allSamples), 99)
+    }
+    if *bootstrap > 0 {
+        r.Confidence = bootstrapIntervals(allResponseTimes, *bootstrap, *confidence)
+    }
+    r.FirstByte = firstByteStats(allSamples)
+    r.ResponseSizes = responseSizeStats(allSamples)
+    if *latencyWindow > 0 {
+        r.Windows = windowStats(allSamples, *latencyWindow)
+    }
+}
+
+// windowStats splits the samples by start time into windows of length
+// window, from the first request, and returns the latency of the completed
+// requests in each.
+func windowStats(samples []sample, window time.Duration) []WindowStats {
+    var first time.Time
+    for _, s := range samples {
+        if first.IsZero() || s.Start.Before(first) {
+            first = s.Start
+        }
+    }
+    var buckets [][]sample
+    for _, s := range samples {
+        i := int(s.Start.Sub(first) / window)
+        for len(buckets) <= i {
+            buckets = append(buckets, nil)
+        }
+        buckets[i] = append(buckets[i], s)
+    }
+    stats := make([]WindowStats, len(buckets))
+    for i, bucket := range buckets {
+        responseTimes := completedResponseTimes(bucket)
+        stats[i] = WindowStats{
+            Start:    window * time.Duration(i),
+            Requests: len(responseTimes),
+            Median:   computePercentile(responseTimes, 50),
+            P99:      computePercentile(responseTimes, 99),
+        }
+    }
+    return stats
+}
+
+// firstByteStats returns the time to first byte percentiles of the completed
+// requests, to set beside the total response time ones. It returns nil when
+// no request was traced, as with non-HTTP protocols.
+func firstByteStats(samples []sample) *FirstByteStats {
+    var times []time.Duration
+    for _, s := range samples {
+        if s.Err == nil && s.TTFB > 0 {
+            times = append(times, s.TTFB)
+        }
+    }
+    if len(times) == 0 {
+        return nil
+    }
+    sort.Slice(times, func(i, j int) bool { return times[i] < times[j] })
+    return &FirstByteStats{
+        Median: computePercentile(times, 50),
+        P90:    computePercentile(times, 90),
+        P95:    computePercentile(times, 95),
+        P99:    computePercentile(times, 99),
+        Max:    times[len(times)-1],
+    }
+}
+
+// responseSizeStats returns the distribution of the body sizes of the
+// completed requests, as received on the wire, or nil when none completed.
+func responseSizeStats(samples []sample) *SizeStats {
+    var sizes []int64
+    for _, s := range samples {
+        if s.Err == nil {
+            sizes = append(sizes, s.Bytes)
+        }
+    }
+    if len(sizes) == 0 {
+        return nil
+    }
+    sort.Slice(sizes, func(i, j int) bool { return sizes[i] < sizes[j] })
+    var total int64
+    for _, n := range sizes {
+        total += n
+    }
+    return &SizeStats{
+        Min:    sizes[0],
+        Mean:   total / int64(len(sizes)),
+        Median: sizePercentile(sizes, 50),
+        P99:    sizePercentile(sizes, 99),
+        Max:    sizes[len(sizes)-1],
+    }
+}
+
+// sizePercentile returns the p-th percentile of ascending sizes, using the
+// nearest-rank method like computePercentile.
+func sizePercentile(sorted []int64, p float64) int64 {
+    idx := int(math.Ceil(p/100*float64(len(sorted)))) - 1
+    if idx < 0 {
+        idx = 0
+    }
+    return sorted[idx]
+}
+
+// hostStats breaks the requests down by target host when -urls-file spreads
+// them over more than one, so a slow backend stands out from the aggregate.
+// It returns nil for a single host.
+func hostStats(samples []sample) map[string]HostStats {
+    byHost := make(map[string][]sample)
+    for _, s := range samples {
+        if s.Host != "" {
+            byHost[s.Host] = append(byHost[s.Host], s)
+        }
+    }
+    if len(byHost) < 2 {
+        return nil
+    }
+
+    stats := make(map[string]HostStats, len(byHost))
+    for host, hostSamples := range byHost {
+        var hs HostStats
+        var times []time.Duration
+        for _, s := range hostSamples {
+            hs.Requests++
+            if s.Err != nil || s.Failed {
+                hs.Failed++
+            }
+            if s.Err == nil {
+                times = append(times, s.Duration)
+                if s.Reused {
+                    hs.ReusedConnections++
+                } else {
+                    hs.NewConnections++
+                }
+            }
+        }
+        if len(times) > 0 {
+            sort.Slice(times, func(i, j int) bool { return times[i] < times[j] })
+            var total time.Duration
+            for _, t := range times {
+                total += t
+            }
+            hs.Mean = total / time.Duration(len(times))
+            hs.Median = computePercentile(times, 50)
+            hs.P99 = computePercentile(times, 99)
+        }
+        stats[host] = hs
+    }
+    return stats
+}
+
+// statusLatencies groups the response times of completed requests by status
+// class, since fast-failing 5xx responses can pull the overall percentiles
+// down.
+func statusLatencies(samples []sample) map[string]LatencyStats {
+    byClass := make(map[string][]time.Duration)
+    for _, s := range samples {
+        if s.Err == nil && s.Status > 0 {
+            key := fmt.Sprintf("%dxx", s.Status/100)
+            byClass[key] = append(byClass[key], s.Duration)
+        }
+    }
+
+    stats := make(map[string]LatencyStats, len(byClass))
+    for key, times := range byClass {
+        sort.Slice(times, func(i, j int) bool { return times[i] < times[j] })
+        var total time.Duration
+        for _, t := range times {
+            total += t
+        }
+        stats[key] = LatencyStats{
+            Count: len(times),
+            Mean:  total / time.Duration(len(times)),
+            P99:   computePercentile(times, 99),
+        }
+    }
+    return stats
+}
+
+// reportResults prints the result in the selected format and plots the
+// response time distribution, plus the latency timeline if requested.
+func reportResults(result Result, allSamples []sample, allResponseTimes []time.Duration) {
+    result.SLAViolations = checkSLA(result)
+    defer func() {
+        // Reported last so the verdict is the final line of the run
+        for _, v := range result.SLAViolations {
+            fmt.Fprintln(logOut, "SLA violated:", v)
+        }
+        if len(result.SLAViolations) > 0 || result.MaxErrorsReached {
+            exitCode = 1
+        }
+    }()
+
+    if *output == "json" {
+        printJSON(os.Stdout, result)
+        if *outputDir != "" || *runName != "" {
+            saveJSON(result, artifactPath(artifactName("results.json")))
+        }
+    } else {
+        printResult(result)
+    }
+
+    if !*noPlot {
+        savePlots(result, allSamples, allResponseTimes)
+    }
+    if *rpsCSVFile != "" {
+        filename := artifactPath(*rpsCSVFile)
+        if err := writeThroughputCSV(result.ThroughputSeries, filename); err != nil {
+            fmt.Fprintln(logOut, "Error writing throughput CSV:", err)
+        } else {
+            fmt.Fprintf(logOut, "Saved throughput series to %s\n", filename)
+        }
+    }
+    if *htmlFile != "" {
+        filename := artifactPath(*htmlFile)
+        if err := writeHTMLReport(result, allSamples, allResponseTimes, filename); err != nil {
+            fmt.Fprintln(logOut, "Error writing HTML report:", err)
+            return
+        }
+        fmt.Fprintf(logOut, "Saved HTML report to %s\n", filename)
+    }
+}
+
+// savePlots plots the response time distribution, plus the timeline charts
+// with -timeline. It runs after the statistics have been printed, and a panic
+// inside the plotting library is reported like any other plot error so that
+// the files written after it are still saved.
+func savePlots(result Result, allSamples []sample, allResponseTimes []time.Duration) {
+    defer func() {
+        if r := recover(); r != nil {
+            fmt.Fprintln(logOut, "Error plotting:", r)
+        }
+    }()
+
+    plotResponseTimes(allResponseTimes, artifactPath(artifactName("response_times.png")), *bins, *logScale, *targetLatency)
+    if *timeline {
+        plotLatencyTimeline(allSamples, artifactPath(artifactName("latency_timeline.png")))
+        plotThroughput(result.ThroughputSeries, artifactPath(artifactName("throughput.png")))
+        plotResourceUsage(result.ResourceUsage, artifactPath(artifactName("resource_usage.png")))
+    }
+}
+
+// maxErrorRate is the parsed -sla-error-rate percentage, or -1 when unset.
+var maxErrorRate float64 = -1
+
+// parsePercent parses a percentage such as "1%" or "0.5".
+func parsePercent(s string) (float64, error) {
+    v, err := strconv.ParseFloat(strings.TrimSuffix(strings.TrimSpace(s), "%"), 64)
+    if err != nil {
+        return 0, err
+    }
+    if v < 0 || v > 100 {
+        return 0, fmt.Errorf("%v is outside 0-100%%", v)
+    }
+    return v, nil
+}
+
+// checkSLA compares the result against -sla-p99 and -sla-error-rate and
+// describes each threshold that was breached.
+func checkSLA(r Result) []string {
+    var violations []string
+    if *slaP99 > 0 && r.P99 > *slaP99 {
+        violations = append(violations, fmt.Sprintf("p99 %v exceeds %v", r.P99, *slaP99))
+    }
+    if maxErrorRate >= 0 && r.TotalRequests > 0 {
+        errorRate := float64(r.FailedRequests) / float64(r.TotalRequests) * 100
+        if errorRate > maxErrorRate {
+            violations = append(violations, fmt.Sprintf("error rate %.2f%% exceeds %.2f%%", errorRate, maxErrorRate))
+        }
+    }
+    return violations
+}
+
+// artifactName returns the name of a generated file, prefixed with -name
+// when one is given so repeated runs don't overwrite each other.
+func artifactName(name string) string {
+    if *runName == "" {
+        return name
+    }
+    return *runName + "_" + name
+}
+
+// repeatRun numbers the run in progress with -repeat, and is 0 otherwise.
+var repeatRun int
+
+// artifactPath places a generated file in -output-dir. Absolute paths are
+// left as they are. With -repeat, the run number is added before the
+// extension so each run keeps its own files.
+func artifactPath(filename string) string {
+    if repeatRun > 0 {
+        ext := filepath.Ext(filename)
+        filename = fmt.Sprintf("%s_run%d%s", strings.TrimSuffix(filename, ext), repeatRun, ext)
+    }
+    if *outputDir == "" || filepath.IsAbs(filename) {
+        return filename
+    }
+    return filepath.Join(*outputDir, filename)
+}
+
+// saveJSON writes a copy of the JSON results to filename.
+func saveJSON(r Result, filename string) {
+    f, err := os.Create(filename)
+    if err != nil {
+        fmt.Fprintln(logOut, "Error saving results:", err)
+        return
+    }
+    printJSON(f, r)
+    if err := f.Close(); err != nil {
+        fmt.Fprintln(logOut, "Error saving results:", err)
+        return
+    }
+    fmt.Fprintf(logOut, "Saved results to %s\n", filename)
+}
+
+// sample is the outcome of a single measured request.
+type sample struct {
+    Start    time.Time
+    Duration time.Duration // measured from when the request was due under -rate
+    Delay    time.Duration // how long after it was due under -rate the request was sent
+    Status   int           // 0 if the request failed before a response arrived
+    TTFB     time.Duration // time to the first response byte, measured like Duration; 0 if untraced
+    Bytes    int64
+    Host     string // target host of an HTTP request
+    Step     string // name of the -script step
+    Client   int    // id of the -client-count client, or 0
+    Reused   bool   // whether the response came over a reused connection
+    Failed   bool   // whether a response that arrived counted as a failure
+    Err      error
+}
+
+// writeCSV writes one row per sample, ordered by start time. The csv.Writer
+// buffers through a bufio.Writer, so rows are flushed to disk in large
+// chunks rather than one write per request.
+func writeCSV(samples []sample, filename string) error {
+    f, err := os.Create(filename)
+    if err != nil {
+        return err
+    }
+    defer f.Close()
+
+    sorted := make([]sample, len(samples))
+    copy(sorted, samples)
+    sort.Slice(sorted, func(i, j int) bool {
+        return sorted[i].Start.Before(sorted[j].Start)
+    })
+
+    w := csv.NewWriter(f)
+    w.Write([]string{"timestamp", "response_time_ms", "status_code", "bytes", "error", "ttfb_ms"})
+    for _, s := range sorted {
+        errText := ""
+        if s.Err != nil {
+            errText = s.Err.Error()
+        }
+        w.Write([]string{
+            s.Start.Format(time.RFC3339Nano),
+            strconv.FormatFloat(float64(s.Duration)/float64(time.Millisecond), 'f', 3, 64),
+            strconv.Itoa(s.Status),
+            strconv.FormatInt(s.Bytes, 10),
+            errText,
+            strconv.FormatFloat(float64(s.TTFB)/float64(time.Millisecond), 'f', 3, 64),
+        })
+    }
+    w.Flush()
+    if err := w.Error(); err != nil {
+        return err
+    }
+    return f.Close()
+}
+
+// throughputSeries counts the requests that completed with a response in
+// each second since the first request started, for spotting ramp-up and dips
+// that the overall throughput averages away.
+func throughputSeries(samples []sample) []int64 {
+    var first time.Time
+    for _, s := range samples {
+        if first.IsZero() || s.Start.Before(first) {
+            first = s.Start
+        }
+    }
+    var series []int64
+    for _, s := range samples {
+        if s.Err != nil {
+            continue
+        }
+        // Duration includes the time a request sat past its due time
+        // under -rate, before Start, so take that back off
+        second := int(s.Start.Add(s.Duration-s.Delay).Sub(first) / time.Second)
+        for len(series) <= second {
+            series = append(series, 0)
+        }
+        series[second]++
+    }
+    return series
+}
+
+// writeThroughputCSV writes one row per second of the throughput series.
+func writeThroughputCSV(series []int64, filename string) error {
+    f, err := os.Create(filename)
+    if err != nil {
+        return err
+    }
+    defer f.Close()
+
+    w := csv.NewWriter(f)
+    w.Write([]string{"second", "requests"})
+    for i, count := range series {
+        w.Write([]string{strconv.Itoa(i), strconv.FormatInt(count, 10)})
+    }
+    w.Flush()
+    if err := w.Error(); err != nil {
+        return err
+    }
+    return f.Close()
+}
+
+// computePercentile returns the p-th percentile (0-100) of an ascending slice
+// of durations using the nearest-rank method. It returns 0 for an empty slice.
+func computePercentile(sorted []time.Duration, p float64) time.Duration {
+    if len(sorted) == 0 {
+        return 0
+    }
+    idx := int(math.Ceil(p/100*float64(len(sorted)))) - 1
+    if idx < 0 {
+        idx = 0
+    }
+    if idx >= len(sorted) {
+        idx = len(sorted) - 1
+    }
+    return sorted[idx]
+}
+
+// percentileLabel names percentile p as the results do, e.g. "Median" or
+// "99th Percentile".
+func percentileLabel(p float64) string {
+    if p == 50 {
+        return "Median"
+    }
+    return fmt.Sprintf("%gth Percentile", p)
+}
+
+// phaseTimings records how long each stage of a single request took, as
+// reported by httptrace. Phases that did not happen, such as DNS and connect
+// on a reused connection, are left at zero.
+type phaseTimings struct {
+    start, dnsStart, connectStart, tlsStart time.Time
+
+    // gotConn is set once a connection was obtained, and reused reports
+    // whether it came from the idle pool
+    gotConn bool
+    reused  bool
+    remote  string // server address of a new connection
+
+    // handshake is set once a TLS handshake succeeded, and resumed reports
+    // whether it resumed a cached session
+    handshake bool
+    resumed   bool
+
+    DNS     time.Duration
+    Connect time.Duration
+    TLS     time.Duration
+    TTFB    time.Duration
+}
+
+// newClientTrace returns a trace that fills in t as the request progresses.
+// t.start must be set just before the request is sent.
+func newClientTrace(t *phaseTimings) *httptrace.ClientTrace {
+    return &httptrace.ClientTrace{
+        GotConn: func(info httptrace.GotConnInfo) {
+            t.gotConn = true
+            t.reused = info.Reused
+            if !info.Reused {
+                t.remote = info.Conn.RemoteAddr().String()
+            }
+        },
+        DNSStart: func(httptrace.DNSStartInfo) {
+            t.dnsStart = time.Now()
+        },
+        DNSDone: func(httptrace.DNSDoneInfo) {
+            t.DNS = time.Since(t.dnsStart)
+        },
+        ConnectStart: func(string, string) {
+            if t.connectStart.IsZero() {
+                t.connectStart = time.Now()
+            }
+        },
+        ConnectDone: func(string, string, error) {
+            t.Connect = time.Since(t.connectStart)
+        },
+        TLSHandshakeStart: func() {
+            t.tlsStart = time.Now()
+        },
+        TLSHandshakeDone: func(state tls.ConnectionState, err error) {
+            t.TLS = time.Since(t.tlsStart)
+            t.handshake, t.resumed = err == nil, state.DidResume
+        },
+        GotFirstResponseByte: func() {
+            t.TTFB = time.Since(t.start)
+        },
+    }
+}
+
+// phaseNames names the phases of phaseSamples, in order.
+var phaseNames = [...]string{"DNS Lookup", "TCP Connect", "TLS Handshake", "Time to First Byte"}
+
+// phaseSamples collects the per-phase durations of many requests. Only the
+// phases a request actually went through are recorded.
+type phaseSamples struct {
+    DNS     []time.Duration
+    Connect []time.Duration
+    TLS     []time.Duration
+    TTFB    []time.Duration
+}
+
+// add records the phases of one request. When the run doesn't retain its
+// samples the durations are only buffered, like samples by keepSample.
+func (s *phaseSamples) add(t *phaseTimings) {
+    if t.DNS > 0 {
+        s.DNS = append(s.DNS, t.DNS)
+    }
+    if t.Connect > 0 {
+        s.Connect = append(s.Connect, t.Connect)
+    }
+    if t.TLS > 0 {
+        s.TLS = append(s.TLS, t.TLS)
+    }
+    if t.TTFB > 0 {
+        s.TTFB = append(s.TTFB, t.TTFB)
+    }
+    if !retainSamples && (len(s.TTFB) >= streamBatch || len(s.Connect) >= streamBatch) {
+        s.flush()
+    }
+}
+
+// flush records the buffered durations in stream and empties the buffer.
+func (s *phaseSamples) flush() {
+    stream.addPhases(s)
+    s.DNS, s.Connect, s.TLS, s.TTFB = s.DNS[:0], s.Connect[:0], s.TLS[:0], s.TTFB[:0]
+}
+
+// merge adds the phases of a worker that stopped, or records them in stream
+// when the run doesn't retain its samples.
+func (s *phaseSamples) merge(o *phaseSamples) {
+    if !retainSamples {
+        o.flush()
+        return
+    }
+    s.gather(o)
+}
+
+// gather appends the phases of o to s. Like add, it records them in stream
+// once a batch has built up when the run doesn't retain its samples.
+func (s *phaseSamples) gather(o *phaseSamples) {
+    s.DNS = append(s.DNS, o.DNS...)
+    s.Connect = append(s.Connect, o.Connect...)
+    s.TLS = append(s.TLS, o.TLS...)
+    s.TTFB = append(s.TTFB, o.TTFB...)
+    if !retainSamples && (len(s.TTFB) >= streamBatch || len(s.Connect) >= streamBatch) {
+        s.flush()
+    }
+}
+
+// summarize sorts the collected samples and returns per-phase statistics,
+// which a run that doesn't retain its samples takes from stream instead.
+func (s *phaseSamples) summarize() []PhaseStats {
+    if !retainSamples {
+        return streamPhaseStats()
+    }
+    // Nothing was traced, as with gRPC and WebSocket calls
+    if len(s.TTFB) == 0 && len(s.Connect) == 0 {
+        return nil
+    }
+
+    phases := []struct {
+        name    string
+        samples []time.Duration
+    }{
+        {phaseNames[0], s.DNS},
+        {phaseNames[1], s.Connect},
+        {phaseNames[2], s.TLS},
+        {phaseNames[3], s.TTFB},
+    }
+
+    var stats []PhaseStats
+    for _, phase := range phases {
+        ps := PhaseStats{Phase: phase.name, Count: len(phase.samples)}
+        if ps.Count > 0 {
+            sort.Slice(phase.samples, func(i, j int) bool {
+                return phase.samples[i] < phase.samples[j]
+            })
+            var total time.Duration
+            for _, d := range phase.samples {
+                total += d
+            }
+            ps.Mean = total / time.Duration(ps.Count)
+            ps.P99 = computePercentile(phase.samples, 99)
+        }
+        stats = append(stats, ps)
+    }
+    return stats
+}
+
+// PhaseStats summarizes one phase of the connection timing breakdown.
+type PhaseStats struct {
+    Phase string        `json:"phase"`
+    Count int           `json:"count"`
+    Mean  time.Duration `json:"mean"`
+    P99   time.Duration `json:"p99"`
+}
+
+// FirstByteStats summarizes the time to first byte of completed requests.
+// Like the response times it is measured from when a request was due, so the
+// two can be compared directly: the gap is the time spent downloading the
+// body.
+type FirstByteStats struct {
+    Median time.Duration `json:"median"`
+    P90    time.Duration `json:"p90"`
+    P95    time.Duration `json:"p95"`
+    P99    time.Duration `json:"p99"`
+    Max    time.Duration `json:"max"`
+}
+
+// SizeStats is the distribution of response body sizes in bytes.
+type SizeStats struct {
+    Min    int64 `json:"min"`
+    Mean   int64 `json:"mean"`
+    Median int64 `json:"median"`
+    P99    int64 `json:"p99"`
+    Max    int64 `json:"max"`
+}
+
+// HostStats summarizes the requests sent to one host. Failed counts the
+// requests that failed by the same rules as FailedRequests, and the
+// connection counts cover the requests that completed.
+type HostStats struct {
+    Requests          int64         `json:"requests"`
+    Failed            int64         `json:"failed"`
+    Mean              time.Duration `json:"mean"`
+    Median            time.Duration `json:"median"`
+    P99               time.Duration `json:"p99"`
+    ReusedConnections int64         `json:"reused_connections"`
+    NewConnections    int64         `json:"new_connections"`
+}
+
+// LatencyStats summarizes the response times of one status class.
+type LatencyStats struct {
+    Count int           `json:"count"`
+    Mean  time.Duration `json:"mean"`
+    P99   time.Duration `json:"p99"`
+}
+
+// BurstStats summarizes the requests sent during one burst phase.
+type BurstStats struct {
+    Requests int           `json:"requests"`
+    Mean     time.Duration `json:"mean"`
+    Median   time.Duration `json:"median"`
+    P99      time.Duration `json:"p99"`
+}
+
+// WindowStats is the latency of the requests started in one -window of a
+// run. Start is the offset of the window from the first request.
+type WindowStats struct {
+    Start    time.Duration `json:"start"`
+    Requests int           `json:"requests"`
+    Median   time.Duration `json:"median"`
+    P99      time.Duration `json:"p99"`
+}
+
+// Result is the summary of a benchmark run. Durations are encoded in JSON
+// as integer nanoseconds.
+type Result struct {
+    Mean               time.Duration           `json:"mean"`
+    Median             time.Duration           `json:"median"`
+    P75                time.Duration           `json:"p75"`
+    P90                time.Duration           `json:"p90"`
+    P95                time.Duration           `json:"p95"`
+    P99                time.Duration           `json:"p99"`
+    P999               time.Duration           `json:"p99_9"`
+    UncorrectedP99     time.Duration           `json:"uncorrected_p99,omitempty"` // p99 measured from actual rather than scheduled send times under -rate
+    Confidence         *ConfidenceIntervals    `json:"confidence_intervals,omitempty"`
+    Min                time.Duration           `json:"min"`
+    Max                time.Duration           `json:"max"`
+    StdDev             time.Duration           `json:"stddev"`
+    Throughput         float64                 `json:"throughput"`
+    ThroughputSeries   []int64                 `json:"throughput_series,omitempty"` // requests completed in each second of the run
+    RampUp             time.Duration           `json:"ramp_up"`
+    Warmup             time.Duration           `json:"warmup"`
+    WarmupRequests     int                     `json:"warmup_requests,omitempty"` // per worker
+    Seed               int64                   `json:"seed"`
+    TargetRate         float64                 `json:"target_rate,omitempty"`
+    AchievedRate       float64                 `json:"achieved_rate,omitempty"`
+    TotalRequests      int64                   `json:"total_requests"`
+    SuccessfulRequests int64                   `json:"successful_requests"`
+    FailedRequests     int64                   `json:"failed_requests"`
+    Timeouts           int64                   `json:"timeouts"`
+    ValidationFailures int64                   `json:"validation_failures"`
+    ConnectFailures    int64                   `json:"connect_failures,omitempty"`
+    TruncatedResponses int64                   `json:"truncated_responses,omitempty"` // bodies longer than -body-limit; not failures
+    Errors             map[string]int64        `json:"errors,omitempty"`              // failed requests by error category
+    ConnectionDrops    int64                   `json:"connection_drops,omitempty"`    // failed requests whose connection the server reset or closed
+    StatusCodes        map[string]int64        `json:"status_codes"`
+    Headers            map[string]HeaderValues `json:"captured_headers,omitempty"` // per -capture-header
+    BodyHashes         *BodyHashStats          `json:"body_hashes,omitempty"`
+    Redirects          int64                   `json:"redirects"`
+    RedirectRate       float64                 `json:"redirect_rate"`     // percent of responses that were redirects
+    Methods            map[string]int64        `json:"methods,omitempty"` // requests sent per method with -method-weights
+    PayloadFiles       int                     `json:"payload_files,omitempty"`
+    PayloadsSent       int                     `json:"payloads_sent,omitempty"`
+    StatusLatency      map[string]LatencyStats `json:"status_latency"`
+    Hosts              map[string]HostStats    `json:"hosts,omitempty"` // per target host with several hosts
+    Steps              []StepStats             `json:"steps,omitempty"` // per -script step
+    Journeys           int64                   `json:"journeys,omitempty"`
+    Clients            []ClientStats           `json:"clients,omitempty"` // per -client-count client, first to last
+    Protocols          map[string]int64        `json:"protocols,omitempty"`
+    TLSVersions        map[string]int64        `json:"tls_versions,omitempty"`
+    TLSSessions        *TLSSessionStats        `json:"tls_sessions,omitempty"`
+    BytesSent          int64                   `json:"bytes_sent"`
+    BytesReceived      int64                   `json:"bytes_received"`
+    EncodedResponses   int64                   `json:"compressed_responses,omitempty"`
+    EncodedBytes       int64                   `json:"compressed_bytes,omitempty"`   // wire size of compressed bodies, included in BytesReceived
+    DecodedBytes       int64                   `json:"decompressed_bytes,omitempty"` // decoded size of the same bodies
+    CompressionRatio   float64                 `json:"compression_ratio,omitempty"`  // DecodedBytes / EncodedBytes
+    SendRate           float64                 `json:"send_rate"`
+    ReceiveRate        float64                 `json:"receive_rate"`
+    ReusedConnections  int64                   `json:"reused_connections"`
+    NewConnections     int64                   `json:"new_connections"`
+    RemoteAddrs        map[string]int64        `json:"remote_addrs,omitempty"` // new connections per server address
+    ReuseRate          float64                 `json:"reuse_rate"`             // percent of requests on a reused connection
+    GCCycles           uint32                  `json:"gc_cycles"`
+    GCPauseTotal       time.Duration           `json:"gc_pause_total"`
+    GCPauseMax         time.Duration           `json:"gc_pause_max"`
+    ResourceUsage      []ResourceSample        `json:"resource_usage,omitempty"`
+    FirstByte          *FirstByteStats         `json:"ttfb,omitempty"`
+    ResponseSizes      *SizeStats              `json:"response_sizes,omitempty"`
+    Phases             []PhaseStats            `json:"phases"`
+    Bursts             []BurstStats            `json:"bursts,omitempty"`
+    Concurrency        *ConcurrencyStats       `json:"concurrency,omitempty"`
+    Pipeline           *PipelineStats          `json:"pipeline,omitempty"`
+    Windows            []WindowStats           `json:"windows,omitempty"`
+    Interrupted        bool                    `json:"interrupted,omitempty"`
+    MaxErrorsReached   bool                    `json:"max_errors_reached,omitempty"` // stopped early by -max-errors
+    AutoStopped        bool                    `json:"auto_stopped,omitempty"`       // stopped early by -auto-stop
+    SLAViolations      []string                `json:"sla_violations,omitempty"`
+}
+
+// printResult writes the human-readable summary to stdout.
+func printResult(r Result) {
+    // A run without a -duration is meant to end with an interrupt
+    if r.Interrupted && *totalRequests == 0 && *duration == 0 {
+        fmt.Printf("\nRun stopped by interrupt.\n")
+    } else if r.Interrupted {
+        fmt.Printf("\nRun was interrupted; statistics cover the partial run.\n")
+    }
+    if r.MaxErrorsReached {
+        fmt.Printf("\nRun was stopped by -max-errors; statistics cover the partial run.\n")
+    }
+    if r.AutoStopped {
+        fmt.Printf("\nRun was stopped by -auto-stop once the p99 settled.\n")
+    }
+    fmt.Printf("\nResponse Time Statistics:\n")
+    fmt.Printf("Mean: %v\n", r.Mean)
+    fmt.Printf("Median: %v\n", r.Median)
+    fmt.Printf("75th Percentile: %v\n", r.P75)
+    fmt.Printf("90th Percentile: %v\n", r.P90)
+    fmt.Printf("95th Percentile: %v\n", r.P95)
+    fmt.Printf("99th Percentile: %v\n", r.P99)
+    fmt.Printf("99.9th Percentile: %v\n", r.P999)
+    if r.TargetRate > 0 {
+        fmt.Printf("99th Percentile (uncorrected): %v\n", r.UncorrectedP99)
+    }
+    fmt.Printf("Min: %v\n", r.Min)
+    fmt.Printf("Max: %v\n", r.Max)
+    fmt.Printf("Standard Deviation: %v\n", r.StdDev)
+
+    // Print how far each percentile could plausibly be off
+    if c := r.Confidence; c != nil {
+        fmt.Printf("\nConfidence Intervals (%g%%, %d resamples):\n", c.Level, c.Resamples)
+        for _, ci := range c.Percentiles {
+            fmt.Printf("%s: %v to %v\n", percentileLabel(ci.Percentile), ci.Low, ci.High)
+        }
+    }
+
+    // Print the per-burst breakdown in burst mode
+    if len(r.Bursts) > 0 {
+        fmt.Printf("\nBurst Phases:\n")
+        for i, b := range r.Bursts {
+            fmt.Printf("Burst %d: %d requests, mean %v, median %v, p99 %v\n", i+1, b.Requests, b.Mean, b.Median, b.P99)
+        }
+    }
+
+    // Print how pipelining compared with sending one request at a time
+    if pl := r.Pipeline; pl != nil {
+        fmt.Printf("\nPipelining:\n")
+        if len(pl.ConnectionDepths) > 0 {
+            lowest, total := pl.ConnectionDepths[0], 0.0
+            for _, d := range pl.ConnectionDepths {
+                lowest = math.Min(lowest, d)
+                total += d
+            }
+            fmt.Printf("Depth: %d, achieved %.1f per batch on average per connection (lowest %.1f)\n",
+                pl.Depth, total/float64(len(pl.ConnectionDepths)), lowest)
+        }
+        fmt.Printf("Throughput: %.2f requests/second, %.2f without pipelining", r.Throughput, pl.BaselineThroughput)
+        if pl.Speedup > 0 {
+            fmt.Printf(" (%.2fx)", pl.Speedup)
+        }
+        fmt.Println()
+    }
+
+    // Print the latency of each -window, so a slowdown over the run shows
+    if len(r.Windows) > 0 {
+        fmt.Printf("\nLatency by Window:\n")
+        for _, w := range r.Windows {
+            fmt.Printf("%v-%v: %d requests, median %v, p99 %v\n", w.Start, w.Start+*latencyWindow, w.Requests, w.Median, w.P99)
+        }
+    }
+
+    // Print how much of the response time was spent waiting for the
+    // server versus reading the body
+    if fb := r.FirstByte; fb != nil {
+        fmt.Printf("\nTime to First Byte vs. Total:\n")
+        fmt.Printf("Median: %v first byte, %v total\n", fb.Median, r.Median)
+        fmt.Printf("90th Percentile: %v first byte, %v total\n", fb.P90, r.P90)
+        fmt.Printf("95th Percentile: %v first byte, %v total\n", fb.P95, r.P95)
+        fmt.Printf("99th Percentile: %v first byte, %v total\n", fb.P99, r.P99)
+        fmt.Printf("Max: %v first byte, %v total\n", fb.Max, r.Max)
+    }
+
+    // Print the spread of body sizes, where an outlier can explain a slow
+    // request
+    if rs := r.ResponseSizes; rs != nil {
+        fmt.Printf("\nResponse Sizes:\n")
+        fmt.Printf("Min: %d bytes, mean %d, median %d, p99 %d, max %d\n", rs.Min, rs.Mean, rs.Median, rs.P99, rs.Max)
+    }
+
+    // Print where the time went
+    if len(r.Phases) > 0 {
+        fmt.Printf("\nConnection Timing Breakdown:\n")
+        for _, ps := range r.Phases {
+            fmt.Printf("%s: mean %v, p99 %v (%d requests)\n", ps.Phase, ps.Mean, ps.P99, ps.Count)
+        }
+    }
+
+    fmt.Printf("\nThroughput: %.2f requests/second\n", r.Throughput)
+    if r.RampUp > 0 {
+        fmt.Printf("Ramp-up: %v (included in the statistics above)\n", r.RampUp)
+    }
+    if r.Warmup > 0 {
+        fmt.Printf("Warmup: %v (excluded from the statistics above)\n", r.Warmup)
+    }
+    if r.WarmupRequests > 0 {
+        fmt.Printf("Warmup: %d requests per worker (excluded from the statistics above)\n", r.WarmupRequests)
+    }
+    if r.TargetRate > 0 {
+        fmt.Printf("Target Rate: %.2f requests/second (achieved %.2f)\n", r.TargetRate, r.AchievedRate)
+    }
+    if c := r.Concurrency; c != nil && *arrivalRate > 0 {
+        fmt.Printf("Concurrency: %.1f in flight on average, at most %d (-max-inflight %d)\n", c.Mean, c.Max, c.Configured)
+    } else if c != nil {
+        fmt.Printf("Concurrency: %d configured, %.1f in flight on average, at most %d\n", c.Configured, c.Mean, c.Max)
+    }
+
+    // Print error statistics
+    fmt.Printf("\nError Statistics:\n")
+    fmt.Printf("Successful Requests: %d\n", r.SuccessfulRequests)
+    fmt.Printf("Failed Requests: %d\n", r.FailedRequests)
+    fmt.Printf("Timeouts: %d\n", r.Timeouts)
+    if *expectStatus != 0 || expectBody != nil {
+        fmt.Printf("Validation Failures: %d\n", r.ValidationFailures)
+    }
+    if r.ConnectFailures > 0 {
+        fmt.Printf("Connection Failures: %d (not included above)\n", r.ConnectFailures)
+    }
+    if r.TruncatedResponses > 0 {
+        fmt.Printf("Responses Past -body-limit: %d (timed up to the limit, not failures)\n", r.TruncatedResponses)
+    }
+
+    // Print what the transport errors were, most frequent first
+    if len(r.Errors) > 0 {
+        fmt.Printf("\nError Types:\n")
+        for _, kind := range keysByCount(r.Errors) {
+            fmt.Printf("%s: %d\n", kind, r.Errors[kind])
+        }
+    }
+    if r.ConnectionDrops > 0 {
+        fmt.Printf("\nConnections Dropped by Server: %d (%.1f%% of failed requests)\n",
+            r.ConnectionDrops, float64(r.ConnectionDrops)/float64(r.FailedRequests)*100)
+        fmt.Println(connectionDropAdvice)
+    }
+
+    // Print the status code breakdown
+    if len(r.StatusCodes) > 0 {
+        fmt.Printf("\nStatus Codes:\n")
+        for class := 1; class < len(statusClasses); class++ {
+            key := fmt.Sprintf("%dxx", class)
+            if count, ok := r.StatusCodes[key]; ok {
+                if ls, ok := r.StatusLatency[key]; ok {
+                    fmt.Printf("%s: %d (mean %v, p99 %v)\n", key, count, ls.Mean, ls.P99)
+                } else {
+                    fmt.Printf("%s: %d\n", key, count)
+                }
+            }
+        }
+    }
+    if r.Redirects > 0 {
+        verb := "followed"
+        if !*followRedirs {
+            verb = "not followed"
+        }
+        fmt.Printf("Redirects: %d (%.1f%% of responses, %s)\n", r.Redirects, r.RedirectRate, verb)
+    }
+
+    // Print the values seen for each -capture-header, most common first
+    if len(r.Headers) > 0 {
+        fmt.Printf("\nCaptured Headers:\n")
+        for _, name := range captureHeaders {
+            counts := r.Headers[name]
+            var total int64
+            for _, n := range counts {
+                total += n
+            }
+            fmt.Printf("%s:\n", name)
+            for _, value := range keysByCount(counts) {
+                fmt.Printf("  %s: %d (%.1f%%)\n", value, counts[value], float64(counts[value])/float64(total)*100)
+            }
+        }
+    }
+
+    // Print how many different bodies came back, and the first few of them
+    if bh := r.BodyHashes; bh != nil {
+        fmt.Printf("\nResponse Bodies: %d distinct in %d responses\n", bh.Distinct, bh.Responses)
+        for _, s := range bh.Samples {
+            preview := s.Body
+            if len(preview) > 60 {
+                preview = preview[:60] + "..."
+            }
+            fmt.Printf("%s: %d (%.1f%%) %q\n", s.Hash, s.Count, float64(s.Count)/float64(bh.Responses)*100, preview)
+        }
+        if bh.Distinct > len(bh.Samples) {
+            fmt.Printf("(%d more not kept)\n", bh.Distinct-len(bh.Samples))
+        }
+    }
+
+    // Print each host on its own when the load was spread over several
+    if len(r.Hosts) > 0 {
+        hosts := make([]string, 0, len(r.Hosts))
+        for host := range r.Hosts {
+            hosts = append(hosts, host)
+        }
+        sort.Strings(hosts)
+        fmt.Printf("\nHosts:\n")
+        for _, host := range hosts {
+            hs := r.Hosts[host]
+            fmt.Printf("%s: %d requests, %d failed, mean %v, median %v, p99 %v, %d reused / %d new connections\n",
+                host, hs.Requests, hs.Failed, hs.Mean, hs.Median, hs.P99, hs.ReusedConnections, hs.NewConnections)
+        }
+    }
+
+    // Print each -script step on its own, in the order they run
+    if len(r.Steps) > 0 {
+        fmt.Printf("\nScript Steps (%d journeys completed):\n", r.Journeys)
+        for _, ss := range r.Steps {
+            fmt.Printf("%s: %d requests, %d failed, mean %v, median %v, p99 %v\n",
+                ss.Name, ss.Requests, ss.Failed, ss.Mean, ss.Median, ss.P99)
+        }
+    }
+
+    // Print how the requests were spread over the simulated clients
+    if len(r.Clients) > 0 {
+        min, max, total := r.Clients[0].Requests, r.Clients[0].Requests, int64(0)
+        for _, cs := range r.Clients {
+            total += cs.Requests
+            if cs.Requests < min {
+                min = cs.Requests
+            }
+            if cs.Requests > max {
+                max = cs.Requests
+            }
+        }
+        fmt.Printf("\nClients: %d, %d to %d requests each (mean %.1f)\n", len(r.Clients), min, max, float64(total)/float64(len(r.Clients)))
+        if len(r.Clients) <= maxClientLines {
+            for i, cs := range r.Clients {
+                fmt.Printf("Client %d: %d requests, %d failed\n", i+1, cs.Requests, cs.Failed)
+            }
+        }
+    }
+
+    // Print the achieved method mix against the requested weights
+    if len(r.Methods) > 0 {
+        var sent int64
+        for _, count := range r.Methods {
+            sent += count
+        }
+        fmt.Printf("\nMethods:\n")
+        for _, choice := range methodMix {
+            count := r.Methods[choice.method]
+            share := 0.0
+            if sent > 0 {
+                share = float64(count) / float64(sent) * 100
+            }
+            fmt.Printf("%s: %d (%.1f%%, target %.1f%%)\n", choice.method, count, share,
+                float64(choice.weight)/float64(methodTotal)*100)
+        }
+    }
+
+    if r.PayloadFiles > 0 {
+        fmt.Printf("\nPayloads: %d of %d files sent\n", r.PayloadsSent, r.PayloadFiles)
+    }
+
+    // Print the protocol each response arrived over
+    if len(r.Protocols) > 0 {
+        fmt.Printf("\nProtocols:\n")
+        for _, name := range protocolNames {
+            if count, ok := r.Protocols[name]; ok {
+                fmt.Printf("%s: %d\n", name, count)
+            }
+        }
+    }
+
+    // Print the negotiated TLS versions
+    if len(r.TLSVersions) > 0 {
+        fmt.Printf("\nTLS Versions:\n")
+        for v := range tlsVersions {
+            name := tlsVersionName(uint16(v + tls.VersionSSL30))
+            if count, ok := r.TLSVersions[name]; ok {
+                fmt.Printf("%s: %d\n", name, count)
+            }
+        }
+    }
+    if s := r.TLSSessions; s != nil {
+        fmt.Printf("TLS Sessions: %d resumed, %d full handshakes (%.1f%% resumed)\n", s.Resumed, s.FullHandshakes, s.ResumeRate)
+        switch {
+        case !s.Cache:
+            fmt.Println("The session cache was off, so no session could be resumed; -tls-session-cache turns it on.")
+        case s.Resumed == 0 && s.FullHandshakes > 1:
+            fmt.Println("No session was resumed: check that the server issues session tickets, or every new connection pays for a full handshake.")
+        }
+    }
+
+    // Print network statistics
+    fmt.Printf("\nNetwork Statistics:\n")
+    fmt.Printf("Bytes Sent: %d (%.0f bytes/second)\n", r.BytesSent, r.SendRate)
+    fmt.Printf("Bytes Received: %d (%.0f bytes/second)\n", r.BytesReceived, r.ReceiveRate)
+    if r.EncodedResponses > 0 {
+        fmt.Printf("Compressed Responses: %d, %d bytes decoded to %d (%.2fx)\n",
+            r.EncodedResponses, r.EncodedBytes, r.DecodedBytes, r.CompressionRatio)
+    }
+    if r.ReusedConnections+r.NewConnections > 0 {
+        fmt.Printf("Connection Reuse: %d reused, %d new (%.1f%% reused)\n", r.ReusedConnections, r.NewConnections, r.ReuseRate)
+    }
+    if len(r.RemoteAddrs) > 0 {
+        addrs := make([]string, 0, len(r.RemoteAddrs))
+        for addr := range r.RemoteAddrs {
+            addrs = append(addrs, addr)
+        }
+        sort.Strings(addrs)
+        for _, addr := range addrs {
+            fmt.Printf("Connected to %s: %d connections\n", addr, r.RemoteAddrs[addr])
+        }
+    }
+
+    // Print the load generator's own garbage collection cost, which shows
+    // when the client rather than the server is the bottleneck
+    fmt.Printf("\nClient GC:\n")
+    fmt.Printf("GC Cycles: %d\n", r.GCCycles)
+    fmt.Printf("Total Pause: %v\n", r.GCPauseTotal)
+    fmt.Printf("Max Pause: %v\n", r.GCPauseMax)
+}
+
+// printJSON writes the summary to w as a single JSON document.
+func printJSON(w io.Writer, r Result) {
+    enc := json.NewEncoder(w)
+    enc.SetIndent("", "  ")
+    if err := enc.Encode(r); err != nil {
+        fmt.Fprintln(os.Stderr, "Error encoding results:", err)
+    }
+}
+
+// validResponse reports whether a response satisfies -expect-status and
+// -expect-body-regex. Either check is skipped when its flag is unset.
+func validResponse(status int, body []byte) bool {
+    if *expectStatus != 0 && status != *expectStatus {
+        return false
+    }
+    return expectBody == nil || expectBody.Match(body)
+}
+
+// countFailure counts a failed request, stopping the run once -max-errors
+// is reached.
+func countFailure() {
+    n := atomic.AddInt64(&failedRequests, 1)
+    if *maxErrors > 0 && n == *maxErrors {
+        atomic.StoreInt32(&errorBudgetExceeded, 1)
+        fmt.Fprintf(logOut, "\nReached -max-errors after %d failed requests, stopping...\n", n)
+        stopRun()
+    }
+}
+
+// recordFailure counts a request that failed before a response was fully
+// read, tallying timeouts separately from other transport errors.
+func recordFailure(err error) {
+    countFailure()
+    if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+        atomic.AddInt64(&timeoutRequests, 1)
+    }
+    recordError(err)
+}
+
+// remoteAddrs counts new connections by the server address they went to,
+// which shows where -resolve or DNS actually sent the load.
+var remoteAddrs struct {
+    mu     sync.Mutex
+    counts map[string]int64
+}
+
+func countRemote(addr string) {
+    remoteAddrs.mu.Lock()
+    if remoteAddrs.counts == nil {
+        remoteAddrs.counts = make(map[string]int64)
+    }
+    remoteAddrs.counts[addr]++
+    remoteAddrs.mu.Unlock()
+}
+
+// remoteCounts returns a copy of the per-address connection counts, or nil
+// when no connection was opened.
+func remoteCounts() map[string]int64 {
+    remoteAddrs.mu.Lock()
+    defer remoteAddrs.mu.Unlock()
+    if len(remoteAddrs.counts) == 0 {
+        return nil
+    }
+    counts := make(map[string]int64, len(remoteAddrs.counts))
+    for k, v := range remoteAddrs.counts {
+        counts[k] = v
+    }
+    return counts
+}
+
+// errorKinds counts failed requests by errorCategory.
+var errorKinds struct {
+    mu     sync.Mutex
+    counts map[string]int64
+}
+
+// recordError adds err to the per-category error counts.
+func recordError(err error) {
+    countError(errorCategory(err))
+}
+
+// countError adds one to the count for category.
+func countError(category string) {
+    errorKinds.mu.Lock()
+    if errorKinds.counts == nil {
+        errorKinds.counts = make(map[string]int64)
+    }
+    errorKinds.counts[category]++
+    errorKinds.mu.Unlock()
+}
+
+// errorCounts returns a copy of the per-category error counts, or nil when
+// no request failed with an error.
+func errorCounts() map[string]int64 {
+    errorKinds.mu.Lock()
+    defer errorKinds.mu.Unlock()
+    if len(errorKinds.counts) == 0 {
+        return nil
+    }
+    counts := make(map[string]int64, len(errorKinds.counts))
+    for k, v := range errorKinds.counts {
+        counts[k] = v
+    }
+    return counts
+}
+
+// maxHeaderValues caps the distinct values counted per -capture-header, so
+// a header that differs on every response, such as a trace ID, can't grow
+// without bound. Values beyond the cap are counted together.
+const maxHeaderValues = 100
+
+// Keys under which -capture-header counts responses without the header and
+// values past maxHeaderValues.
+const (
+    headerMissing = "(missing)"
+    headerOther   = "(other values)"
+)
+
+// HeaderValues counts responses by the value of a captured header.
+type HeaderValues map[string]int64
+
+// capturedHeaders counts the values of each -capture-header.
+var capturedHeaders struct {
+    mu     sync.Mutex
+    counts map[string]HeaderValues
+}
+
+// captureHeaderValues counts the values of the -capture-header headers in a
+// response. Repeated headers are counted as their comma-joined value.
+func captureHeaderValues(header http.Header) {
+    capturedHeaders.mu.Lock()
+    defer capturedHeaders.mu.Unlock()
+    if capturedHeaders.counts == nil {
+        capturedHeaders.counts = make(map[string]HeaderValues)
+    }
+    for _, name := range captureHeaders {
+        counts := capturedHeaders.counts[name]
+        if counts == nil {
+            counts = make(HeaderValues)
+            capturedHeaders.counts[name] = counts
+        }
+        value := headerMissing
+        if values := header.Values(name); len(values) > 0 {
+            value = strings.Join(values, ", ")
+        }
+        if _, seen := counts[value]; !seen && len(counts) >= maxHeaderValues {
+            value = headerOther
+        }
+        counts[value]++
+    }
+}
+
+// headerCounts returns a copy of the -capture-header counts, or nil when no
+// header was captured.
+func headerCounts() map[string]HeaderValues {
+    capturedHeaders.mu.Lock()
+    defer capturedHeaders.mu.Unlock()
+    if len(capturedHeaders.counts) == 0 {
+        return nil
+    }
+    headers := make(map[string]HeaderValues, len(capturedHeaders.counts))
+    for name, counts := range capturedHeaders.counts {
+        headers[name] = make(HeaderValues, len(counts))
+        for value, n := range counts {
+            headers[name][value] = n
+        }
+    }
+    return headers
+}
+
+// keysByCount returns the keys of counts, most frequent first and then in
+// alphabetical order.
+func keysByCount(counts map[string]int64) []string {
+    kinds := make([]string, 0, len(counts))
+    for kind := range counts {
+        kinds = append(kinds, kind)
+    }
+    sort.Slice(kinds, func(i, j int) bool {
+        if counts[kinds[i]] != counts[kinds[j]] {
+            return counts[kinds[i]] > counts[kinds[j]]
+        }
+        return kinds[i] < kinds[j]
+    })
+    return kinds
+}
+
+// errorCategory maps a request error to a short, stable description by
+// unwrapping it to the underlying error types, so the same failure is
+// counted together however the message text varies.
+func errorCategory(err error) string {
+    var (
+        netErr  net.Error
+        dnsErr  *net.DNSError
+        opErr   *net.OpError
+        recErr  tls.RecordHeaderError
+        authErr x509.UnknownAuthorityError
+        hostErr x509.HostnameError
+        certErr x509.CertificateInvalidError
+    )
+    switch {
+    case errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+        return "timeout"
+    case errors.Is(err, context.Canceled):
+        return "canceled"
+    case errors.Is(err, syscall.ECONNREFUSED):
+        return "connection refused"
+    case errors.Is(err, syscall.ECONNRESET):
+        return "connection reset"
+    case errors.Is(err, syscall.EPIPE):
+        return "broken pipe"
+    case errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+        return "connection closed (EOF)"
+    case errors.As(err, &dnsErr):
+        return "DNS lookup failed"
+    case errors.As(err, &recErr), errors.As(err, &authErr), errors.As(err, &hostErr), errors.As(err, &certErr):
+        return "TLS error"
+    case errors.As(err, &opErr):
+        return opErr.Op + " error"
+    }
+    return "other"
+}
+
+// connectionDropKinds are the error categories of requests whose connection
+// the server reset or closed under them, rather than failing them with a
+// response.
+var connectionDropKinds = []string{"connection reset", "broken pipe", "connection closed (EOF)"}
+
+// connectionDropAdvice explains what connection drops usually point at.
+const connectionDropAdvice = "The server reset or closed connections with requests on them. Under load this usually means it hit a " +
+    "connection limit (e.g. nginx worker_connections, a database pool, ulimit -n), overflowed its listen backlog " +
+    "(net.core.somaxconn), or closes idle keep-alive connections sooner than the client expects; check those, " +
+    "or lower -concurrency to confirm the failures follow the load."
+
+// connectionDrops returns how many of the failed requests counted in errors
+// were connection drops.
+func connectionDrops(errors map[string]int64) int64 {
+    var n int64
+    for _, kind := range connectionDropKinds {
+        n += errors[kind]
+    }
+    return n
+}
+
+// trackResourceUsage samples the client's CPU and memory usage once per
+// second for the progress line until the context is cancelled, then marks
+// wg done. Each CPU sample itself spans the one-second interval.
+func trackResourceUsage(ctx context.Context, wg *sync.WaitGroup) {
+    defer wg.Done()
+
+    var beginningMem runtime.MemStats
+    runtime.ReadMemStats(&beginningMem)
+    usage.mu.Lock()
+    usage.startMem = beginningMem
+    usage.mu.Unlock()
+
+    // Stop once the benchmark has finished
+    for ctx.Err() == nil {
+        // Collect CPU usage; with -per-cpu the overall figure is the
+        // average across cores
+        cpuUsage, err := cpu.PercentWithContext(ctx, time.Second, *perCPU)
+        if err != nil {
+            if ctx.Err() != nil {
+                return
+            }
+            // A failed reading loses one sample, not the rest of the run
+            fmt.Fprintln(logOut, "Error getting CPU usage:", err)
+            select {
+            case <-time.After(time.Second):
+            case <-ctx.Done():
+            }
+            continue
+        }
+        if len(cpuUsage) == 0 {
+            continue
+        }
+        sample := ResourceSample{Time: time.Now(), CPU: cpuUsage[0]}
+        if *perCPU {
+            sample.PerCPU = cpuUsage
+            sample.CPU = 0
+            for _, c := range cpuUsage {
+                sample.CPU += c / float64(len(cpuUsage))
+            }
+        }
+
+        // Collect memory usage
+        var currentMem runtime.MemStats
+        runtime.ReadMemStats(&currentMem)
+        sample.MemoryMB = currentMem.Alloc / 1024 / 1024
+
+        usage.mu.Lock()
+        usage.cpu = sample.CPU
+        usage.memoryMB = sample.MemoryMB
+        usage.samples = append(usage.samples, sample)
+        usage.mu.Unlock()
+    }
+}
+
+// usage holds the resource samples taken by trackResourceUsage, the latest
+// of which is also kept for the progress line, and the memory statistics
+// from when it started for measuring GC activity.
+var usage struct {
+    mu       sync.Mutex
+    cpu      float64
+    memoryMB uint64
+    samples  []ResourceSample
+    startMem runtime.MemStats
+}
+
+// ResourceSample is the client's CPU and memory usage over one second of
+// the run.
+type ResourceSample struct {
+    Time     time.Time `json:"time"`
+    CPU      float64   `json:"cpu_percent"`
+    PerCPU   []float64 `json:"per_cpu_percent,omitempty"`
+    MemoryMB uint64    `json:"memory_mb"`
+}
+
+// resourceSamples returns a copy of the resource samples taken so far.
+func resourceSamples() []ResourceSample {
+    usage.mu.Lock()
+    defer usage.mu.Unlock()
+    return append([]ResourceSample(nil), usage.samples...)
+}
+
+// gcSinceStart returns the number of GC cycles, the total pause time and the
+// longest single pause since trackResourceUsage started. The runtime only
+// keeps the most recent 256 pause times, so on longer runs the maximum only
+// covers those.
+func gcSinceStart() (cycles uint32, total, longest time.Duration) {
+    var mem runtime.MemStats
+    runtime.ReadMemStats(&mem)
+    usage.mu.Lock()
+    start := usage.startMem
+    usage.mu.Unlock()
+
+    cycles = mem.NumGC - start.NumGC
+    total = time.Duration(mem.PauseTotalNs - start.PauseTotalNs)
+    for i := uint32(0); i < cycles && i < uint32(len(mem.PauseNs)); i++ {
+        // PauseNs is a circular buffer with the latest pause at (NumGC+255)%256
+        pause := time.Duration(mem.PauseNs[(mem.NumGC-i+255)%uint32(len(mem.PauseNs))])
+        if pause > longest {
+            longest = pause
+        }
+    }
+    return cycles, total, longest
+}
+
+// showProgress enables the live status line. It is only set when stdout is a
+// terminal, since the carriage returns make a mess of redirected output.
+var showProgress bool
+
+// progress collects response times as they complete for -auto-stop, which
+// takes them one stability window at a time.
+var progress struct {
+    mu    sync.Mutex
+    times []time.Duration
+}
+
+// recordProgress adds a completed response time to the running statistics
+// shown on the status line, watched by -auto-stop and exported as metrics.
+func recordProgress(d time.Duration) {
+    observeLatency(d)
+    recordHdr(d)
+    if !*autoStop {
+        return
+    }
+    progress.mu.Lock()
+    progress.times = append(progress.times, d)
+    progress.mu.Unlock()
+}
+
+// minStableSamples is the fewest response times a window needs before
+// -auto-stop trusts its p99.
+const minStableSamples = 100
+
+// stopWhenStable implements -auto-stop. Once the warmup is over it computes
+// the p99 of the response times recorded in each -stability-window, and calls
+// stop when it has stayed within -stability-threshold percent of the previous
+// window's for -stability-windows windows in a row. A window with too few
+// responses for a meaningful p99 starts the count again.
+func stopWhenStable(ctx context.Context, stop context.CancelFunc, measureStart time.Time) {
+    select {
+    case <-time.After(time.Until(measureStart)):
+    case <-ctx.Done():
+        return
+    }
+    ticker := time.NewTicker(*stabilityWindow)
+    defer ticker.Stop()
+
+    progress.mu.Lock()
+    progress.times = nil
+    progress.mu.Unlock()
+    var last time.Duration
+    stable := 0
+    for {
+        select {
+        case <-ticker.C:
+        case <-ctx.Done():
+            return
+        }
+        progress.mu.Lock()
+        window := progress.times
+        progress.times = nil
+        progress.mu.Unlock()
+
+        if len(window) < minStableSamples {
+            last, stable = 0, 0
+            continue
+        }
+        sort.Slice(window, func(i, j int) bool { return window[i] < window[j] })
+        p99 := computePercentile(window, 99)
+        if last > 0 && math.Abs(float64(p99-last))/float64(last)*100 < *stabilityThreshold {
+            stable++
+        } else {
+            stable = 0
+        }
+        last = p99
+        if stable >= *stabilityWindows {
+            atomic.StoreInt32(&autoStopped, 1)
+            fmt.Fprintf(logOut, "\np99 settled at %v over %d windows, stopping...\n", p99, stable+1)
+            stop()
+            return
+        }
+    }
+}
+
+// isTerminal reports whether f is attached to a terminal rather than a file,
+// pipe or other device such as /dev/null.
+func isTerminal(f *os.File) bool {
+    return term.IsTerminal(int(f.Fd()))
+}
+
+// startProgress redraws a single status line every second with the requests
+// completed, the current request rate, the running p99, errors, resource
+// usage and network rates. The returned function stops the updates and ends
+// the line so the results can be printed below it.
+func startProgress(ctx context.Context) (stop func()) {
+    if !showProgress {
+        return func() {}
+    }
+
+    ctx, cancel := context.WithCancel(ctx)
+    done := make(chan struct{})
+    go func() {
+        defer close(done)
+
+        start := time.Now()
+        lastCount := atomic.LoadInt64(&successfulRequests) + atomic.LoadInt64(&failedRequests)
+        lastSent := atomic.LoadInt64(&bytesSent)
+        lastReceived := atomic.LoadInt64(&bytesReceived)
+        lastTime := start
+
+        ticker := time.NewTicker(time.Second)
+        defer ticker.Stop()
+        for {
+            select {
+            case <-ticker.C:
+            case <-ctx.Done():
+                fmt.Fprintln(logOut)
+                return
+            }
+
+            now := time.Now()
+            elapsed := now.Sub(lastTime).Seconds()
+            errors := atomic.LoadInt64(&failedRequests)
+            count := atomic.LoadInt64(&successfulRequests) + errors
+            sent := atomic.LoadInt64(&bytesSent)
+            received := atomic.LoadInt64(&bytesReceived)
+
+            latencyHdr.mu.Lock()
+            p99 := time.Duration(nearestRank(latencyHdr.h, 99))
+            latencyHdr.mu.Unlock()
+
+            usage.mu.Lock()
+            cpuPercent, memoryMB := usage.cpu, usage.memoryMB
+            usage.mu.Unlock()
+
+            // \033[K clears whatever a longer previous line left behind
+            fmt.Fprintf(logOut, "\r[%v] %d requests, %.0f req/s, p99 %v, %d errors | CPU %.1f%%, %d MB | sent %.0f B/s, received %.0f B/s\033[K",
+                now.Sub(start).Round(time.Second), count, float64(count-lastCount)/elapsed,
+                p99.Round(time.Microsecond), errors,
+                cpuPercent, memoryMB,
+                float64(sent-lastSent)/elapsed, float64(received-lastReceived)/elapsed)
+
+            lastCount, lastSent, lastReceived, lastTime = count, sent, received, now
+        }
+    }()
+
+    return func() {
+        cancel()
+        <-done
+    }
+}
+
+// targetHosts returns the distinct hosts among the target URLs, counting a
+// URL that can't be parsed, such as a template, or that has no host, such as
+// a gRPC host:port, as a host of its own.
+func targetHosts() map[string]bool {
+    hosts := make(map[string]bool)
+    for _, target := range targetURLs {
+        if u, err := url.Parse(target); err == nil && u.Host != "" {
+            hosts[u.Host] = true
+        } else {
+            hosts[target] = true
+        }
+    }
+    return hosts
+}
+
+// buildTLSConfig returns the TLS settings from -insecure, -tls-session-cache,
+// -cacert, -cert and -key.
+func buildTLSConfig() (*tls.Config, error) {
+    tlsConfig := &tls.Config{InsecureSkipVerify: *insecure}
+    if *tlsSessionCache {
+        tlsConfig.ClientSessionCache = tls.NewLRUClientSessionCache(0)
+    }
 
-    // Error handling for missing server flag
-    if *server == "" {
-        fmt.Println("Please specify the server URL using the -server flag")
-        return
+    if *caCert != "" {
+        pem, err := os.ReadFile(*caCert)
+        if err != nil {
+            return nil, err
+        }
+        pool := x509.NewCertPool()
+        if !pool.AppendCertsFromPEM(pem) {
+            return nil, fmt.Errorf("no certificates found in %s", *caCert)
+        }
+        tlsConfig.RootCAs = pool
+    }
+
+    if *clientCert != "" || *clientKey != "" {
+        if *clientCert == "" || *clientKey == "" {
+            return nil, fmt.Errorf("-cert and -key must be given together")
+        }
+        cert, err := tls.LoadX509KeyPair(*clientCert, *clientKey)
+        if err != nil {
+            return nil, err
+        }
+        tlsConfig.Certificates = []tls.Certificate{cert}
     }
+    return tlsConfig, nil
+}
 
-    req, err := createRequest()
+// buildTransport returns the transport shared by every request, configured
+// with the TLS and protocol options from the flags.
+func buildTransport(dial func(ctx context.Context, network, addr string) (net.Conn, error)) (http.RoundTripper, error) {
+    tlsConfig, err := buildTLSConfig()
     if err != nil {
-        fmt.Println("Error creating request:", err)
-        return
+        return nil, err
+    }
+
+    // h2c needs the dedicated HTTP/2 transport, dialing plain TCP where it
+    // would normally dial TLS
+    if *http2Only {
+        return &http2.Transport{
+            AllowHTTP:          true,
+            DisableCompression: true,
+            DialTLSContext: func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+                return dial(ctx, network, addr)
+            },
+        }, nil
+    }
+
+    transport := http.DefaultTransport.(*http.Transport).Clone()
+    transport.TLSClientConfig = tlsConfig
+    transport.DialContext = dial
+
+    // Accept-Encoding is set by createRequest and responses are decoded by
+    // the workers, which count the compressed bytes the transport would hide
+    transport.DisableCompression = true
+
+    if *proxyURL != "" {
+        proxy, err := proxyFunc(*proxyURL)
+        if err != nil {
+            return nil, err
+        }
+        transport.Proxy = proxy
+    }
+
+    // Keep enough idle connections around for every worker to reuse one;
+    // the default of 2 per host forces most workers to reconnect. With
+    // -connections, workers beyond the limit wait for a free connection (or
+    // share one over HTTP/2), so there is never more to keep idle.
+    idle := *maxIdleConns
+    if idle <= 0 {
+        idle = *concurrency
+        if *mode == "burst" && *burstConcurrency > idle {
+            idle = *burstConcurrency
+        }
+        if *connections > 0 && *connections < idle {
+            idle = *connections
+        }
+    }
+    // The idle limit applies per host, and the overall limit is raised to
+    // match so that one busy host can't crowd the others out of the pool
+    transport.MaxConnsPerHost = *connections
+    transport.MaxIdleConnsPerHost = idle
+    if total := idle * len(targetHosts()); total > transport.MaxIdleConns {
+        transport.MaxIdleConns = total
     }
-    resp, err := http.DefaultClient.Do(req)
-    fmt.Println(resp)
 
-    go trackResourceUsage()
-    go benchmark()
-    go monitorNetwork()
+    // Without keep-alives every request pays for its own TCP and TLS
+    // handshake, which the timing breakdown then shows per request
+    transport.DisableKeepAlives = !*keepAlive
+
+    // Offer only h2 during ALPN so the connection can't fall back to HTTP/1.1
+    if *forceHTTP2 {
+        if err := http2.ConfigureTransport(transport); err != nil {
+            return nil, err
+        }
+        transport.TLSClientConfig.NextProtos = []string{http2.NextProtoTLS}
+    }
+    return transport, nil
 }
 
-func benchmark() {
-    startTime := time.Now()
+// proxyFunc returns a transport Proxy function that routes every request
+// through rawURL, except for hosts excluded by the NO_PROXY environment
+// variable. httpproxy never proxies localhost and loopback addresses, so it
+// is only used when NO_PROXY is set; otherwise local targets go through the
+// proxy too.
+func proxyFunc(rawURL string) (func(*http.Request) (*url.URL, error), error) {
+    u, err := url.Parse(rawURL)
+    if err != nil {
+        return nil, err
+    }
+    switch u.Scheme {
+    case "http", "https", "socks5":
+    default:
+        return nil, fmt.Errorf("unsupported proxy scheme %q (expected http, https or socks5)", u.Scheme)
+    }
 
-    // Collect and sort response times
-    var wg sync.WaitGroup
-    wg.Add(1)
-    var allResponseTimes []time.Duration
+    noProxy := os.Getenv("NO_PROXY")
+    if noProxy == "" {
+        noProxy = os.Getenv("no_proxy")
+    }
+    if noProxy == "" {
+        return http.ProxyURL(u), nil
+    }
+    config := &httpproxy.Config{HTTPProxy: rawURL, HTTPSProxy: rawURL, NoProxy: noProxy}
+    proxy := config.ProxyFunc()
+    return func(req *http.Request) (*url.URL, error) {
+        return proxy(req.URL)
+    }, nil
+}
 
-    go func() {
-        defer wg.Done()
-        for {
-            req, err := createRequest() // Use the customizable request function
-            if err != nil {
-                continue
-            }
-            resp, err := http.DefaultClient.Do(req)
+// protocolIndex maps a response protocol version to its slot in protocols,
+// or returns -1 for versions that aren't tracked.
+func protocolIndex(major, minor int) int {
+    switch {
+    case major == 1 && (minor == 0 || minor == 1):
+        return minor
+    case major == 2:
+        return 2
+    case major == 3:
+        return 3
+    }
+    return -1
+}
+
+// tlsVersionName returns a readable name for a TLS protocol version.
+func tlsVersionName(version uint16) string {
+    switch version {
+    case tls.VersionSSL30:
+        return "SSL 3.0"
+    case tls.VersionTLS10:
+        return "TLS 1.0"
+    case tls.VersionTLS11:
+        return "TLS 1.1"
+    case tls.VersionTLS12:
+        return "TLS 1.2"
+    case tls.VersionTLS13:
+        return "TLS 1.3"
+    }
+    return fmt.Sprintf("0x%04x", version)
+}
+
+// countingReader wraps a request body and adds every byte read from it to
+// the bytesSent counter.
+type countingReader struct {
+    io.ReadCloser
+}
+
+func (c countingReader) Read(p []byte) (int, error) {
+    n, err := c.ReadCloser.Read(p)
+    atomic.AddInt64(&bytesSent, int64(n))
+    return n, err
+}
+
+// streamBlock is the data -stream-size bodies repeat. It is random so that
+// compression along the way can't shrink the upload.
+var streamBlock = func() []byte {
+    b := make([]byte, 32*1024)
+    rand.Read(b)
+    return b
+}()
+
+// streamReader produces a -stream-size body as it is read, so a large upload
+// costs no more memory than a small one.
+type streamReader struct {
+    remaining int64
+    offset    int
+}
+
+func (s *streamReader) Read(p []byte) (int, error) {
+    if s.remaining <= 0 {
+        return 0, io.EOF
+    }
+    if int64(len(p)) > s.remaining {
+        p = p[:s.remaining]
+    }
+    n := copy(p, streamBlock[s.offset:])
+    s.offset = (s.offset + n) % len(streamBlock)
+    s.remaining -= int64(n)
+    return n, nil
+}
+
+// byteCounter counts the bytes read through it.
+type byteCounter struct {
+    r io.Reader
+    n int64
+}
+
+func (b *byteCounter) Read(p []byte) (int, error) {
+    n, err := b.r.Read(p)
+    b.n += int64(n)
+    return n, err
+}
+
+// decodeBody returns a reader that decompresses a response body sent with
+// the given Content-Encoding, and whether it is compressed. Encodings other
+// than gzip and deflate are read as they are.
+func decodeBody(encoding string, r io.Reader) (io.Reader, bool, error) {
+    var decoder io.Reader
+    var err error
+    switch strings.ToLower(strings.TrimSpace(encoding)) {
+    case "gzip", "x-gzip":
+        decoder, err = gzip.NewReader(r)
+    case "deflate":
+        decoder, err = zlib.NewReader(r)
+    default:
+        return r, false, nil
+    }
+    // A compressed response may still have an empty body, as with HEAD or
+    // 304 Not Modified
+    if err == io.EOF {
+        return r, false, nil
+    }
+    return decoder, err == nil, err
+}
+
+// readURLs loads a newline-delimited list of URLs, skipping blank lines and
+// lines starting with '#'.
+func readURLs(path string) ([]string, error) {
+    data, err := os.ReadFile(path)
+    if err != nil {
+        return nil, err
+    }
+
+    var urls []string
+    for _, line := range strings.Split(string(data), "\n") {
+        line = strings.TrimSpace(line)
+        if line == "" || strings.HasPrefix(line, "#") {
+            continue
+        }
+        urls = append(urls, line)
+    }
+    if len(urls) == 0 {
+        return nil, fmt.Errorf("no URLs found in %s", path)
+    }
+    return urls, nil
+}
+
+// nextURL picks the URL for the next request according to -url-order,
+// drawing from rng when the order is random.
+func nextURL(rng *rand.Rand) string {
+    if len(targetURLs) == 1 {
+        return targetURLs[0]
+    }
+    if *urlOrder == "random" {
+        return targetURLs[rng.Intn(len(targetURLs))]
+    }
+    n := atomic.AddUint64(&urlCounter, 1) - 1
+    return targetURLs[n%uint64(len(targetURLs))]
+}
+
+// parseHeaders parses comma-separated key=value pairs into a map. Only the
+// first '=' separates the key from the value, so values may contain '='.
+// A comma inside a value must be escaped as "\,", and a literal backslash
+// as "\\". Whitespace around keys and values is dropped.
+func parseHeaders(s string) map[string]string {
+    headersMap := make(map[string]string)
+
+    var pairs []string
+    var current strings.Builder
+    for i := 0; i < len(s); i++ {
+        switch {
+        case s[i] == '\\' && i+1 < len(s) && (s[i+1] == ',' || s[i+1] == '\\'):
+            i++
+            current.WriteByte(s[i])
+        case s[i] == ',':
+            pairs = append(pairs, current.String())
+            current.Reset()
+        default:
+            current.WriteByte(s[i])
+        }
+    }
+    pairs = append(pairs, current.String())
+
+    for _, pair := range pairs {
+        kv := strings.SplitN(pair, "=", 2)
+        if len(kv) == 2 && strings.TrimSpace(kv[0]) != "" {
+            headersMap[strings.TrimSpace(kv[0])] = strings.TrimSpace(kv[1])
+        }
+    }
+    return headersMap
+}
+
+// createRequest builds a request for url bound to ctx, so cancelling ctx
+// aborts the request even while it is waiting on the server. Random choices,
+// such as the method under -method-weights, are drawn from rng.
+func createRequest(ctx context.Context, url string, rng *rand.Rand) (*http.Request, error) {
+    // With -method-weights each request draws its method, and possibly its
+    // own payload, from the mix
+    requestMethod, body, bodyTemplate := *method, payloadBytes, payloadTemplate
+    if len(dirPayloads) > 0 {
+        body = pickPayload(rng)
+    }
+    if len(methodMix) > 0 {
+        choice := pickMethod(rng)
+        requestMethod = choice.method
+        if choice.payload != nil {
+            body, bodyTemplate = choice.payload, choice.template
+        }
+    }
+
+    // Fill in any {{.Seq}} and {{.Rand}} placeholders, sharing the same
+    // values between the URL and the payload
+    if t := urlTemplates[url]; t != nil || bodyTemplate != nil {
+        vars := requestVars{Seq: atomic.AddUint64(&requestSeq, 1), Rand: rng.Int63()}
+        if t != nil {
+            rendered, err := renderTemplate(t, vars)
             if err != nil {
-                continue
+                return nil, err
             }
-
-            startTime := time.Now()
-            err = resp.Body.Close()
+            url = string(rendered)
+        }
+        if bodyTemplate != nil {
+            rendered, err := renderTemplate(bodyTemplate, vars)
             if err != nil {
-                continue
+                return nil, err
             }
-            responseTime := time.Since(startTime)
+            body = rendered
+        }
+    }
+    return buildRequest(ctx, requestMethod, url, body, nil)
+}
 
-            // Thread-safe access to the slice
-            wg.Add(1)
-            go func(rt time.Duration) {
-                defer wg.Done()
-                allResponseTimes = append(allResponseTimes, rt)
-            }(responseTime)
+// bodylessMethod reports whether requests with method m are not expected to
+// carry a body, so that a body given for them is most likely a mistake.
+func bodylessMethod(m string) bool {
+    return strings.EqualFold(m, http.MethodGet) || strings.EqualFold(m, http.MethodHead)
+}
 
-            // Check if benchmark duration has elapsed
-            if time.Since(startTime) > *duration {
-                break
-            }
+// buildRequest creates a request with the given method, URL and body and
+// applies every per-request flag to it: the multipart form, headers,
+// authentication, cookies and signing. Headers in header, such as those of a
+// -script step, replace any of the same name from -H and -headers.
+func buildRequest(ctx context.Context, requestMethod, url string, body []byte, header http.Header) (*http.Request, error) {
+    // A multipart body is written afresh for every request, with its own
+    // boundary, from the values and file contents loaded at startup
+    contentType := ""
+    if len(formValues.values) > 0 || len(uploads) > 0 {
+        var err error
+        body, contentType, err = multipartBody()
+        if err != nil {
+            return nil, err
         }
-    }()
-
-    wg.Wait()
-    sort.Slice(allResponseTimes, func(i, j int) bool {
-        return allResponseTimes[i] < allResponseTimes[j]
-    })
+    }
 
-    // Calculate and print response time statistics
-    mean := time.Duration(0)
-    for _, rt := range allResponseTimes {
-        mean += rt
+    // Create the request with customization. A -stream-size body has no
+    // length up front, so it is sent chunked.
+    var bodyReader io.Reader = bytes.NewReader(body)
+    if *streamSize > 0 {
+        bodyReader = &streamReader{remaining: *streamSize}
+    }
+    req, err := http.NewRequestWithContext(ctx, requestMethod, url, bodyReader)
+    if err != nil {
+        return nil, err
+    }
+    if *streamSize > 0 {
+        req.ContentLength = -1
+    }
+    if contentType != "" {
+        req.Header.Set("Content-Type", contentType)
+    }
+    for key, values := range requestHeaders {
+        // net/http sends req.Host rather than a Host header
+        if key == "Host" {
+            req.Host = values[0]
+            continue
+        }
+        req.Header[key] = append(req.Header[key], values...)
+    }
+    for key, values := range header {
+        if key == "Host" {
+            req.Host = values[0]
+            continue
+        }
+        req.Header[key] = values
     }
-    mean /= time.Duration(len(allResponseTimes))
 
-    median := allResponseTimes[len(allResponseTimes)/2]
-    p99 := allResponseTimes[int(0.99*float64(len(allResponseTimes)))]
+    // An Accept-Encoding given with -H wins over -accept-encoding
+    if *acceptEncoding != "" && req.Header.Get("Accept-Encoding") == "" {
+        req.Header.Set("Accept-Encoding", *acceptEncoding)
+    }
 
-    fmt.Printf("\nResponse Time Statistics:\n")
-    fmt.Printf("Mean: %v\n", mean)
-    fmt.Printf("Median: %v\n", median)
-    fmt.Printf("99th Percentile: %v\n", p99)
+    // Authentication flags take precedence over an Authorization header
+    if basicAuthValue != "" {
+        user, pass, _ := strings.Cut(basicAuthValue, ":")
+        req.SetBasicAuth(user, pass)
+    } else if bearerValue != "" {
+        req.Header.Set("Authorization", "Bearer "+bearerValue)
+    }
 
-    // Calculate and print throughput
-    throughput := float64(len(allResponseTimes)) / duration.Seconds() // Use total request count
-    fmt.Printf("\nThroughput: %.2f requests/second\n", throughput)
+    // With -cookies or -client-count the seed cookies live in the jars
+    // instead
+    if !*useCookies && len(simClients) == 0 {
+        for _, cookie := range seedCookies {
+            req.AddCookie(cookie)
+        }
+    }
 
-    // Print error statistics
-    fmt.Printf("\nError Statistics:\n")
-    fmt.Printf("Failed Requests: %d\n", len(allResponseTimes)-successfulRequests) // Calculate based on total count
+    // Signing comes last, once every header it may cover is in place
+    if signRequest != nil {
+        if err := signRequest(req, body, time.Now()); err != nil {
+            return nil, err
+        }
+    }
+    return req, nil
+}
 
-    // Plot the response time distribution
-    plotResponseTimes(allResponseTimes, "response_times.png")
+// multipartBody encodes the -form values and -form-file uploads as a
+// multipart/form-data body and returns it with its Content-Type.
+func multipartBody() ([]byte, string, error) {
+    var buf bytes.Buffer
+    w := multipart.NewWriter(&buf)
+    for _, value := range formValues.values {
+        field, val, _ := strings.Cut(value, "=")
+        if err := w.WriteField(field, val); err != nil {
+            return nil, "", err
+        }
+    }
+    for _, upload := range uploads {
+        part, err := w.CreateFormFile(upload.field, upload.filename)
+        if err != nil {
+            return nil, "", err
+        }
+        if _, err := part.Write(upload.data); err != nil {
+            return nil, "", err
+        }
+    }
+    if err := w.Close(); err != nil {
+        return nil, "", err
+    }
+    return buf.Bytes(), w.FormDataContentType(), nil
 }
 
+// compileTemplates parses the target URLs and payload that contain template
+// placeholders, rendering each once so a bad field name is reported at
+// startup rather than on every request.
+func compileTemplates() error {
+    for _, target := range targetURLs {
+        if !strings.Contains(target, "{{") {
+            continue
+        }
+        t, err := template.New(target).Parse(target)
+        if err != nil {
+            return err
+        }
+        if _, err := renderTemplate(t, requestVars{}); err != nil {
+            return err
+        }
+        if urlTemplates == nil {
+            urlTemplates = make(map[string]*template.Template)
+        }
+        urlTemplates[target] = t
+    }
 
-func trackResourceUsage() {
-    var beginningMem runtime.MemStats
-    runtime.ReadMemStats(&beginningMem)
-    startTime := time.Now()
+    if bytes.Contains(payloadBytes, []byte("{{")) {
+        t, err := template.New("payload").Parse(string(payloadBytes))
+        if err != nil {
+            return err
+        }
+        if _, err := renderTemplate(t, requestVars{}); err != nil {
+            return err
+        }
+        payloadTemplate = t
+    }
+    return nil
+}
 
-    go func() {
-        for {
-            // Collect CPU usage
-            cpuUsage, err := cpu.Percent(time.Second, false)
-            if err != nil {
-                fmt.Println("Error getting CPU usage:", err)
-                continue
+// parseMethodWeights parses -method-weights entries of the form
+// METHOD:WEIGHT or METHOD:WEIGHT:@file, reading each payload file once.
+func parseMethodWeights(spec string) ([]methodChoice, error) {
+    var choices []methodChoice
+    for _, entry := range strings.Split(spec, ",") {
+        parts := strings.SplitN(strings.TrimSpace(entry), ":", 3)
+        if len(parts) < 2 || parts[0] == "" {
+            return nil, fmt.Errorf("expected METHOD:WEIGHT, got %q", entry)
+        }
+        weight, err := strconv.Atoi(parts[1])
+        if err != nil || weight <= 0 {
+            return nil, fmt.Errorf("weight for %s must be a positive integer, got %q", parts[0], parts[1])
+        }
+        choice := methodChoice{method: strings.ToUpper(parts[0]), weight: weight}
+        for _, prev := range choices {
+            if prev.method == choice.method {
+                return nil, fmt.Errorf("%s is listed more than once", choice.method)
+            }
+        }
+        if len(parts) == 3 {
+            if !strings.HasPrefix(parts[2], "@") {
+                return nil, fmt.Errorf("expected METHOD:WEIGHT:@file, got %q", entry)
             }
+            if choice.payload, err = os.ReadFile(parts[2][1:]); err != nil {
+                return nil, err
+            }
+            if bytes.Contains(choice.payload, []byte("{{")) {
+                t, err := template.New(choice.method).Parse(string(choice.payload))
+                if err != nil {
+                    return nil, err
+                }
+                if _, err := renderTemplate(t, requestVars{}); err != nil {
+                    return nil, err
+                }
+                choice.template = t
+            }
+        }
+        choices = append(choices, choice)
+    }
+    return choices, nil
+}
 
-            // Collect memory usage
-            var currentMem runtime.MemStats
-            runtime.ReadMemStats(&currentMem)
+// pickMethod chooses a -method-weights entry at random in proportion to the
+// weights.
+func pickMethod(rng *rand.Rand) *methodChoice {
+    n := rng.Intn(methodTotal)
+    for i := range methodMix {
+        if n < methodMix[i].weight {
+            return &methodMix[i]
+        }
+        n -= methodMix[i].weight
+    }
+    return &methodMix[len(methodMix)-1]
+}
 
-            // Print or save resource usage metrics
-            fmt.Printf("CPU Usage: %.2f%%\n", cpuUsage[0])
-            fmt.Printf("Memory Usage: %d MB\n", currentMem.Alloc/1024/1024)
+// countMethod records a measured request toward the achieved method mix.
+func countMethod(method string) {
+    for i := range methodMix {
+        if methodMix[i].method == method {
+            atomic.AddInt64(&methodMix[i].sent, 1)
+            return
+        }
+    }
+}
 
-            // Check if benchmark duration has elapsed
-            if time.Since(startTime) > *duration {
-                break
-            }
+// renderTemplate executes t with the given request values.
+func renderTemplate(t *template.Template, vars requestVars) ([]byte, error) {
+    var buf bytes.Buffer
+    if err := t.Execute(&buf, vars); err != nil {
+        return nil, err
+    }
+    return buf.Bytes(), nil
+}
 
-            time.Sleep(time.Second) // Adjust interval as needed
+// newSessionClient returns a client sharing the global transport but with its
+// own cookie jar, seeded with the -cookie values for every target URL, so a
+// worker keeps a session across its requests.
+func newSessionClient() *http.Client {
+    // cookiejar.New only fails on invalid options
+    jar, _ := cookiejar.New(nil)
+    for _, target := range targetURLs {
+        if u, err := url.Parse(target); err == nil {
+            jar.SetCookies(u, seedCookies)
         }
-    }()
+    }
+    return &http.Client{Timeout: client.Timeout, Transport: client.Transport, CheckRedirect: client.CheckRedirect, Jar: jar}
 }
 
-func monitorNetwork() {
-    var wg sync.WaitGroup
-    wg.Add(1)
+// plotResponseTimes saves a histogram of the sorted response times with the
+// given number of bins, optionally with a logarithmic count axis so the
+// sparse bins of a long tail stay visible.
+func plotResponseTimes(responseTimes []time.Duration, filename string, bins int, logScale bool, target time.Duration) {
+    p, err := responseTimeHistogram(responseTimes, bins, logScale, target)
+    if err != nil {
+        fmt.Fprintln(logOut, "Error creating histogram:", err)
+        return
+    }
 
-    go func() {
-        defer wg.Done()
+    // Save the plot; the format follows the file extension
+    if err := p.Save(8*vg.Inch, 4*vg.Inch, filename); err != nil {
+        fmt.Fprintln(logOut, "Error saving plot:", err)
+        return
+    }
 
-        startTime := time.Now()
-        var bytesSent int64
-        var bytesReceived int64
-        var connectionsOpened int64
-        var connectionErrors int64
+    fmt.Fprintf(logOut, "Saved response time distribution to %s\n", filename)
+}
 
-        for {
+// responseTimeHistogram builds the histogram of response times drawn by
+// plotResponseTimes and embedded in the HTML report. With a target latency
+// the bins beyond it are drawn in red behind a line marking it, and the
+// title gives the share of requests over it.
+func responseTimeHistogram(responseTimes []time.Duration, bins int, logScale bool, target time.Duration) (*plot.Plot, error) {
+    p := plot.New()
+
+    p.Title.Text = "Response Time Distribution"
+    p.X.Label.Text = "Response Time (ms)"
+    p.Y.Label.Text = "Count"
+    var hist *plotter.Histogram
+    var err error
+    var over, total float64
+    if n := len(responseTimes); n > 0 {
+        p.X.Label.Text = fmt.Sprintf("Response Time (ms), %.3f to %.3f",
+            float64(responseTimes[0])/float64(time.Millisecond),
+            float64(responseTimes[n-1])/float64(time.Millisecond))
 
-            // Example using net/http/pprof:
-            pprofStats := new(pprof.Profile).Count()
-            bytesSent += pprofStats.BytesSent
-            bytesReceived += pprofStats.BytesReceived
-            connectionsOpened += pprofStats.ConnsCreated
+        // Convert durations to milliseconds
+        msValues := make(plotter.Values, 0, len(responseTimes))
+        for _, rt := range responseTimes {
+            msValues = append(msValues, float64(rt)/float64(time.Millisecond))
+        }
+        hist, err = plotter.NewHist(msValues, bins)
+        over = float64(n - sort.Search(n, func(i int) bool { return responseTimes[i] > target }))
+        total = float64(n)
+    } else {
+        // Without the samples, each bar of the streaming histogram is
+        // binned with its count as the weight
+        min, max, bars := streamLatencyBars()
+        p.X.Label.Text = fmt.Sprintf("Response Time (ms), %.3f to %.3f",
+            float64(min)/float64(time.Millisecond), float64(max)/float64(time.Millisecond))
+        hist, err = plotter.NewHistogram(bars, bins)
+        for _, bar := range bars {
+            if bar.X > float64(target)/float64(time.Millisecond) {
+                over += bar.Y
+            }
+            total += bar.Y
+        }
+    }
+    if err != nil {
+        return nil, err
+    }
+    if logScale {
+        hist.LogY = true
+        p.Y.Scale = plot.LogScale{}
+        p.Y.Tick.Marker = plot.LogTicks{Prec: -1}
+        p.Y.Label.Text = "Count (log scale)"
+    }
+    hist.FillColor = color.Gray{Y: 102}
+    hist.LineStyle.Color = color.Gray{Y: 0}
+    hist.LineStyle.Width = vg.Points(0.5)
 
-            // Print or save network metrics
-            fmt.Printf("\nNetwork Metrics:\n")
-            fmt.Printf("Bytes Sent: %d\n", bytesSent)
-            fmt.Printf("Bytes Received: %d\n", bytesReceived)
-            fmt.Printf("Connections Opened: %d\n", connectionsOpened)
-            fmt.Printf("Connection Errors: %d\n", connectionErrors)
+    // Add histogram to the plot
+    p.Add(hist)
 
-            // Check if benchmark duration has elapsed
-            if time.Since(startTime) > *duration {
-                break
+    if target > 0 && total > 0 {
+        targetMs := float64(target) / float64(time.Millisecond)
+        beyond := &plotter.Histogram{Width: hist.Width, FillColor: color.RGBA{R: 204, G: 51, B: 51, A: 255}, LineStyle: hist.LineStyle, LogY: hist.LogY}
+        for _, bin := range hist.Bins {
+            if bin.Min >= targetMs {
+                beyond.Bins = append(beyond.Bins, bin)
             }
+        }
+        if len(beyond.Bins) > 0 {
+            p.Add(beyond)
+        }
 
-            time.Sleep(time.Second) // Adjust interval as needed
+        // The line spans the count axis as the bins set it
+        line, err := plotter.NewLine(plotter.XYs{{X: targetMs, Y: p.Y.Min}, {X: targetMs, Y: p.Y.Max}})
+        if err != nil {
+            return nil, err
         }
-    }()
+        line.Color = color.RGBA{R: 204, A: 255}
+        line.Width = vg.Points(1.5)
+        line.Dashes = []vg.Length{vg.Points(6), vg.Points(3)}
+        p.Add(line)
+        p.Title.Text = fmt.Sprintf("Response Time Distribution, %.1f%% over the %v target", over/total*100, target)
+    }
+    return p, nil
+}
 
-    wg.Wait()
+// maxTimelinePoints caps the number of points drawn by plotLatencyTimeline.
+const maxTimelinePoints = 2000
+
+// plotLatencyTimeline draws the response time of each completed request
+// against the time since the first request started.
+func plotLatencyTimeline(samples []sample, filename string) {
+    p, err := latencyTimeline(samples)
+    if err != nil {
+        fmt.Fprintln(logOut, "Error creating timeline:", err)
+        return
+    }
+    if p == nil {
+        return
+    }
+
+    if err := p.Save(8*vg.Inch, 4*vg.Inch, filename); err != nil {
+        fmt.Fprintln(logOut, "Error saving plot:", err)
+        return
+    }
+
+    fmt.Fprintf(logOut, "Saved latency timeline to %s\n", filename)
 }
 
-func createRequest() (*http.Request, error) {
-    // Parse headers into a map
-    headersMap := make(map[string]string)
-    if *headers != "" {
-        for _, pair := range strings.Split(*headers, ",") {
-            kv := strings.Split(pair, "=")
-            if len(kv) == 2 {
-                headersMap[kv[0]] = kv[1]
-            }
+// latencyTimeline builds the plot drawn by plotLatencyTimeline, or returns
+// nil when no request completed. Large runs are downsampled by averaging
+// consecutive samples into maxTimelinePoints points.
+func latencyTimeline(samples []sample) (*plot.Plot, error) {
+    var completed []sample
+    for _, s := range samples {
+        if s.Err == nil {
+            completed = append(completed, s)
+        }
+    }
+    if len(completed) == 0 {
+        return nil, nil
+    }
+    sort.Slice(completed, func(i, j int) bool {
+        return completed[i].Start.Before(completed[j].Start)
+    })
+
+    first := completed[0].Start
+    chunk := (len(completed) + maxTimelinePoints - 1) / maxTimelinePoints
+    var points plotter.XYs
+    for i := 0; i < len(completed); i += chunk {
+        end := i + chunk
+        if end > len(completed) {
+            end = len(completed)
+        }
+        var elapsed, latency float64
+        for _, s := range completed[i:end] {
+            elapsed += s.Start.Sub(first).Seconds()
+            latency += float64(s.Duration) / float64(time.Millisecond)
         }
+        n := float64(end - i)
+        points = append(points, plotter.XY{X: elapsed / n, Y: latency / n})
     }
 
-    // Create the request with customization
-    req, err := http.NewRequest(*method, *server, bytes.NewBufferString(*payload))
+    p := plot.New()
+    p.Title.Text = "Response Time Over Time"
+    p.X.Label.Text = "Elapsed Time (s)"
+    p.Y.Label.Text = "Response Time (ms)"
+
+    line, err := plotter.NewLine(points)
     if err != nil {
         return nil, err
     }
-    for key, value := range headersMap {
-        req.Header.Set(key, value)
-    }
-    return req, nil
+    line.LineStyle.Width = vg.Points(1)
+    p.Add(line)
+    return p, nil
 }
 
-func plotResponseTimes(responseTimes []time.Duration, filename string) {
-    p, err := plot.New()
+// plotThroughput draws the throughput series as requests per second against
+// elapsed time.
+func plotThroughput(series []int64, filename string) {
+    p, err := throughputPlot(series)
     if err != nil {
-        fmt.Println("Error creating plot:", err)
+        fmt.Fprintln(logOut, "Error creating throughput plot:", err)
+        return
+    }
+    if p == nil {
         return
     }
 
-    p.Title.Text = "Response Time Distribution"
-    p.X.Label.Text = "Response Time (ms)"
-    p.Y.Label.Text = "Count"
+    if err := p.Save(8*vg.Inch, 4*vg.Inch, filename); err != nil {
+        fmt.Fprintln(logOut, "Error saving plot:", err)
+        return
+    }
 
-    // Convert durations to milliseconds
-    var msValues []float64
-    for _, rt := range responseTimes {
-        msValues = append(msValues, float64(rt.Milliseconds()))
+    fmt.Fprintf(logOut, "Saved throughput timeline to %s\n", filename)
+}
+
+// throughputPlot builds the plot drawn by plotThroughput, or returns nil
+// when the series is empty. Each second is plotted at its midpoint.
+func throughputPlot(series []int64) (*plot.Plot, error) {
+    if len(series) == 0 {
+        return nil, nil
+    }
+    points := make(plotter.XYs, len(series))
+    for i, count := range series {
+        points[i] = plotter.XY{X: float64(i) + 0.5, Y: float64(count)}
     }
 
-    // Create and customize histogram
-    hist, err := plotter.NewHist(msValues, 20) // 20 bins
+    p := plot.New()
+    p.Title.Text = "Throughput Over Time"
+    p.X.Label.Text = "Elapsed Time (s)"
+    p.Y.Label.Text = "Requests/second"
+    p.Y.Min = 0
+
+    line, err := plotter.NewLine(points)
     if err != nil {
-        fmt.Println("Error creating histogram:", err)
+        return nil, err
+    }
+    line.LineStyle.Width = vg.Points(1)
+    p.Add(line)
+    return p, nil
+}
+
+// plotResourceUsage draws the client's CPU usage, per core when sampled,
+// and memory against elapsed time.
+func plotResourceUsage(samples []ResourceSample, filename string) {
+    if len(samples) == 0 {
         return
     }
-    hist.Color = plot.Gray{0.4}
-    hist.FillStyle = plotter.RectangleStyle{
-        Pattern:    plotter.Gray{},
-        StrokeColor: plot.Gray{0},
-        StrokeWidth: vg.Points(0.5),
+
+    p := plot.New()
+    p.Title.Text = "Client Resource Usage"
+    p.X.Label.Text = "Elapsed Time (s)"
+    p.Y.Label.Text = "CPU (%) / Memory (MB)"
+    p.Y.Min = 0
+    p.Legend.Top = true
+
+    first := samples[0].Time
+    cpuPoints := make(plotter.XYs, len(samples))
+    memPoints := make(plotter.XYs, len(samples))
+    for i, s := range samples {
+        elapsed := s.Time.Sub(first).Seconds()
+        cpuPoints[i] = plotter.XY{X: elapsed, Y: s.CPU}
+        memPoints[i] = plotter.XY{X: elapsed, Y: float64(s.MemoryMB)}
     }
+    lines := []interface{}{"CPU (%)", cpuPoints, "Memory (MB)", memPoints}
 
-    // Add histogram to the plot
-    p.Add(hist)
+    // Per-core lines are only drawn when every sample has the same cores
+    if cores := len(samples[0].PerCPU); cores > 0 {
+        for core := 0; core < cores; core++ {
+            points := make(plotter.XYs, 0, len(samples))
+            for _, s := range samples {
+                if len(s.PerCPU) == cores {
+                    points = append(points, plotter.XY{X: s.Time.Sub(first).Seconds(), Y: s.PerCPU[core]})
+                }
+            }
+            lines = append(lines, fmt.Sprintf("CPU %d (%%)", core), points)
+        }
+    }
+    if err := plotutil.AddLines(p, lines...); err != nil {
+        fmt.Fprintln(logOut, "Error creating resource usage plot:", err)
+        return
+    }
 
-    // Save the plot as a PNG image
-    if err := p.Save(filename, svg.Inches(8), svg.Inches(4)); err != nil {
-        fmt.Println("Error saving plot:", err)
+    if err := p.Save(8*vg.Inch, 4*vg.Inch, filename); err != nil {
+        fmt.Fprintln(logOut, "Error saving plot:", err)
         return
     }
 
-    fmt.Printf("Saved response time distribution to %s\n", filename)
+    fmt.Fprintf(logOut, "Saved resource usage timeline to %s\n", filename)
 }
 
-func burstTest() {
-    fmt.Println("Starting burst test...")
+// burstTest alternates between bursts of -burst-concurrency workers and idle
+// rest periods until -duration has elapsed, then returns the combined
+// statistics alongside a per-burst breakdown, like benchmark.
+func burstTest(ctx context.Context) (Result, []sample, []time.Duration, error) {
+    fmt.Fprintln(logOut, "Starting burst test...")
+    fmt.Fprintf(logOut, "Bursts of %d workers for %v, resting %v in between, %s\n",
+        *burstConcurrency, *burstDuration, *restDuration, runLength())
+    fmt.Fprintf(logOut, "Random seed %d (replay with -seed %d)\n", runSeed, runSeed)
+    logRateCap()
+    if *connections > 0 {
+        fmt.Fprintf(logOut, "Limiting to %d connections per host\n", *connections)
+    }
+    if !*keepAlive {
+        fmt.Fprintln(logOut, "Keep-alive disabled: opening a new connection for every request")
+    }
+    if *thinkTime > 0 || *thinkJitter > 0 {
+        fmt.Fprintf(logOut, "Workers pause %v (plus up to %v) between requests\n", *thinkTime, *thinkJitter)
+    }
 
-    // Burst parameters
-    burstDuration := 5 * time.Second
-    burstConcurrency := 100
-    restDuration := 10 * time.Second
+    var allSamples []sample
+    var allPhases phaseSamples
+    var bursts []BurstStats
+    var window time.Duration
+    var burstEnd time.Time
 
+    stopProgress := startProgress(ctx)
     startTime := time.Now()
-    for {
+    for ctx.Err() == nil {
         // Burst phase
-        fmt.Println("Starting burst phase...")
-        time.Sleep(burstDuration)
+        fmt.Fprintf(logOut, "Starting burst phase %d...\n", len(bursts)+1)
+        burstCtx, cancel := context.WithTimeout(ctx, *burstDuration)
+        burstStart := time.Now()
+        pool := &workerPool{workers: *burstConcurrency, measureStart: burstStart, drainTimeout: *drainTimeout, open: protocolOpener}
+        samples, phases := pool.run(burstCtx)
+        cancel()
+        burstEnd = time.Now()
+        window += burstEnd.Sub(burstStart)
 
-        // Rest phase
-        fmt.Println("Starting rest phase...")
-        time.Sleep(restDuration)
+        allSamples = append(allSamples, samples...)
+        allPhases.merge(&phases)
+        bursts = append(bursts, summarizeBurst(samples))
 
         // Check if overall duration has elapsed
-        if time.Since(startTime) > *duration {
+        if *duration > 0 && time.Since(startTime) > *duration {
             break
         }
+
+        // Rest phase
+        fmt.Fprintln(logOut, "Starting rest phase...")
+        select {
+        case <-time.After(*restDuration):
+        case <-ctx.Done():
+        }
     }
 
-    fmt.Println("Burst test complete.")
-}
\ No newline at end of file
+    stopProgress()
+    fmt.Fprintln(logOut, "Burst test complete.")
+    saveSamples(allSamples)
+
+    // Throughput is relative to the time spent bursting, not resting
+    allResponseTimes := completedResponseTimes(allSamples)
+    if len(allResponseTimes) == 0 {
+        return Result{}, allSamples, nil, errNoResults
+    }
+    result := summarize(allSamples, allResponseTimes, &allPhases, window)
+    result.Bursts = bursts
+    saveRaw(result, allSamples, window)
+    saveHdr(burstEnd.Add(-window), burstEnd)
+    return result, allSamples, allResponseTimes, nil
+}
+
+// summarizeBurst computes the latency statistics of a single burst phase.
+func summarizeBurst(samples []sample) BurstStats {
+    responseTimes := completedResponseTimes(samples)
+    stats := BurstStats{Requests: len(samples)}
+    if len(responseTimes) == 0 {
+        return stats
+    }
+    var total time.Duration
+    for _, rt := range responseTimes {
+        total += rt
+    }
+    stats.Mean = total / time.Duration(len(responseTimes))
+    stats.Median = computePercentile(responseTimes, 50)
+    stats.P99 = computePercentile(responseTimes, 99)
+    return stats
+}
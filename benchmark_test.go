@@ -0,0 +1,240 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"math"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// TestConcurrentWorkers runs several workers against a local server, under
+// go test -race, and checks that every request is counted and every response
+// time merged exactly once.
+func TestConcurrentWorkers(t *testing.T) {
+    var hits int64
+    srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        atomic.AddInt64(&hits, 1)
+        w.Write([]byte("ok"))
+    }))
+    defer srv.Close()
+
+    url, workers, requests, keep, noPlot := srv.URL, 8, int64(200), true, true
+    r := &Runner{Config: Config{Server: &url, Concurrency: &workers, Requests: &requests, KeepSamples: &keep, NoPlot: &noPlot}}
+    result, err := r.Run(context.Background())
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    if result.TotalRequests != requests || result.SuccessfulRequests != requests {
+        t.Errorf("got %d requests, %d successful; want %d", result.TotalRequests, result.SuccessfulRequests, requests)
+    }
+    if got := atomic.LoadInt64(&hits); got != requests {
+        t.Errorf("server saw %d requests, want %d", got, requests)
+    }
+    if got := len(r.ResponseTimes()); int64(got) != requests {
+        t.Errorf("got %d response times, want %d", got, requests)
+    }
+}
+
+// TestRunnerConfig checks that a second Runner's config takes effect over
+// the flags the first one set.
+func TestRunnerConfig(t *testing.T) {
+    srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+    defer srv.Close()
+
+    url, workers := srv.URL, 2
+    for _, requests := range []int64{20, 5} {
+        requests := requests
+        r := &Runner{Config: Config{Server: &url, Concurrency: &workers, Requests: &requests}}
+        result, err := r.Run(context.Background())
+        if err != nil {
+            t.Fatal(err)
+        }
+        if result.TotalRequests != requests {
+            t.Errorf("got %d requests, want %d", result.TotalRequests, requests)
+        }
+    }
+}
+
+// TestPlotResponseTimes plots a small synthetic set of response times and
+// checks that the PNG is written.
+func TestPlotResponseTimes(t *testing.T) {
+    var times []time.Duration
+    for i := 1; i <= 100; i++ {
+        times = append(times, time.Duration(i)*time.Millisecond)
+    }
+    filename := filepath.Join(t.TempDir(), "response_times.png")
+    plotResponseTimes(times, filename, 20, false, 0)
+
+    info, err := os.Stat(filename)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if info.Size() == 0 {
+        t.Errorf("%s is empty", filename)
+    }
+}
+
+func TestParseHeaders(t *testing.T) {
+    tests := []struct {
+        in   string
+        want map[string]string
+    }{
+        {"X-A=1,X-B=2", map[string]string{"X-A": "1", "X-B": "2"}},
+        {"Authorization=Basic dXNlcjpwYXNz==", map[string]string{"Authorization": "Basic dXNlcjpwYXNz=="}},
+        {"X-Query=a=1&b=2", map[string]string{"X-Query": "a=1&b=2"}},
+        {`Accept=text/html\, application/json,X-B=2`, map[string]string{"Accept": "text/html, application/json", "X-B": "2"}},
+        {`X-Path=C:\\dir`, map[string]string{"X-Path": `C:\dir`}},
+        {"  X-A = 1 , X-B=  two words  ", map[string]string{"X-A": "1", "X-B": "two words"}},
+        {"X-Empty=,=nokey,novalue", map[string]string{"X-Empty": ""}},
+        {"", map[string]string{}},
+    }
+    for _, tt := range tests {
+        if got := parseHeaders(tt.in); !reflect.DeepEqual(got, tt.want) {
+            t.Errorf("parseHeaders(%q) = %q, want %q", tt.in, got, tt.want)
+        }
+    }
+}
+
+// TestConfigCoversFlags checks that every flag that shapes a run can also be
+// set from a -config file, so the two don't drift apart.
+func TestConfigCoversFlags(t *testing.T) {
+    // Flags that pick what the program does rather than configuring a run
+    excluded := map[string]bool{
+        "analyze":   true,
+        "compare":   true,
+        "config":    true,
+        "dry-run":   true,
+        "self-test": true,
+        "threshold": true,
+    }
+    fields := make(map[string]bool)
+    configType := reflect.TypeOf(Config{})
+    for i := 0; i < configType.NumField(); i++ {
+        // the flag a field sets, as apply finds it
+        field := configType.Field(i)
+        name := field.Tag.Get("flag")
+        if name == "" {
+            name = field.Tag.Get("yaml")
+        }
+        fields[name] = true
+    }
+    flag.CommandLine.VisitAll(func(f *flag.Flag) {
+        // go test registers its own flags on the same flag set
+        if strings.HasPrefix(f.Name, "test.") {
+            return
+        }
+        if !excluded[f.Name] && !fields[f.Name] {
+            t.Errorf("flag -%s has no Config field", f.Name)
+        }
+    })
+}
+
+// TestSummarizeStream feeds the same samples through the streaming
+// statistics and the exact ones and checks that they agree: counts, minimum,
+// maximum and mean exactly, and percentiles to three significant figures.
+func TestSummarizeStream(t *testing.T) {
+    rng := rand.New(rand.NewSource(1))
+    origin := time.Now()
+    var samples []sample
+    for i := 0; i < 10000; i++ {
+        d := time.Duration(math.Exp(rng.NormFloat64())*float64(5*time.Millisecond)) + time.Microsecond
+        s := sample{
+            Start:    origin.Add(time.Duration(i) * 100 * time.Microsecond),
+            Duration: d,
+            Status:   http.StatusOK,
+            TTFB:     d / 2,
+            Bytes:    100 + rng.Int63n(100000),
+            Host:     []string{"a:80", "b:80"}[i%2],
+            Reused:   i%3 != 0,
+        }
+        switch {
+        case i%50 == 0:
+            s.Status, s.TTFB, s.Err = 0, 0, errors.New("timeout")
+        case i%13 == 0:
+            s.Status, s.Failed = http.StatusInternalServerError, true
+        case i%7 == 0:
+            s.Status, s.Failed = http.StatusNotFound, true
+        }
+        samples = append(samples, s)
+    }
+    window := time.Second
+
+    var want, got Result
+    summarizeSamples(&want, samples, completedResponseTimes(samples), window)
+    stream.reset(origin)
+    stream.add(samples)
+    summarizeStream(&got, window)
+
+    within := func(name string, got, want time.Duration) {
+        if math.Abs(float64(got-want)) > float64(want)/1000 {
+            t.Errorf("%s = %v, want %v to 3 significant figures", name, got, want)
+        }
+    }
+    if got.Min != want.Min || got.Max != want.Max || got.Mean != want.Mean || got.Throughput != want.Throughput {
+        t.Errorf("min, max, mean, throughput = %v, %v, %v, %v; want %v, %v, %v, %v",
+            got.Min, got.Max, got.Mean, got.Throughput, want.Min, want.Max, want.Mean, want.Throughput)
+    }
+    within("median", got.Median, want.Median)
+    within("p75", got.P75, want.P75)
+    within("p90", got.P90, want.P90)
+    within("p95", got.P95, want.P95)
+    within("p99", got.P99, want.P99)
+    within("p99.9", got.P999, want.P999)
+
+    for class, w := range want.StatusLatency {
+        g := got.StatusLatency[class]
+        if g.Count != w.Count || g.Mean != w.Mean {
+            t.Errorf("%s count, mean = %d, %v; want %d, %v", class, g.Count, g.Mean, w.Count, w.Mean)
+        }
+        within(class+" p99", g.P99, w.P99)
+    }
+    if len(got.StatusLatency) != len(want.StatusLatency) {
+        t.Errorf("got %d status classes, want %d", len(got.StatusLatency), len(want.StatusLatency))
+    }
+
+    for host, w := range want.Hosts {
+        g := got.Hosts[host]
+        if g.Requests != w.Requests || g.Failed != w.Failed || g.ReusedConnections != w.ReusedConnections ||
+            g.NewConnections != w.NewConnections || g.Mean != w.Mean {
+            t.Errorf("host %s = %+v, want %+v", host, g, w)
+        }
+        within(host+" median", g.Median, w.Median)
+        within(host+" p99", g.P99, w.P99)
+    }
+    if len(got.Hosts) != len(want.Hosts) {
+        t.Errorf("got %d hosts, want %d", len(got.Hosts), len(want.Hosts))
+    }
+
+    if got.FirstByte == nil || want.FirstByte == nil {
+        t.Fatalf("first byte stats = %v, want %v", got.FirstByte, want.FirstByte)
+    }
+    if got.FirstByte.Max != want.FirstByte.Max {
+        t.Errorf("first byte max = %v, want %v", got.FirstByte.Max, want.FirstByte.Max)
+    }
+    within("first byte median", got.FirstByte.Median, want.FirstByte.Median)
+    within("first byte p99", got.FirstByte.P99, want.FirstByte.P99)
+
+    if got.ResponseSizes == nil || want.ResponseSizes == nil {
+        t.Fatalf("response sizes = %v, want %v", got.ResponseSizes, want.ResponseSizes)
+    }
+    gs, ws := *got.ResponseSizes, *want.ResponseSizes
+    if gs.Min != ws.Min || gs.Max != ws.Max || gs.Mean != ws.Mean {
+        t.Errorf("response size min, max, mean = %d, %d, %d; want %d, %d, %d", gs.Min, gs.Max, gs.Mean, ws.Min, ws.Max, ws.Mean)
+    }
+    within("response size p99", time.Duration(gs.P99), time.Duration(ws.P99))
+
+    if !reflect.DeepEqual(got.ThroughputSeries, want.ThroughputSeries) {
+        t.Errorf("throughput series = %v, want %v", got.ThroughputSeries, want.ThroughputSeries)
+    }
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"hash"
+	"hash/fnv"
+	"sort"
+	"sync"
+)
+
+// maxBodySamples is how many distinct bodies -hash-bodies keeps for
+// inspection. Only the first bodies seen with each hash are kept.
+const maxBodySamples = 5
+
+// maxBodySampleBytes caps how much of each kept body is stored.
+const maxBodySampleBytes = 4096
+
+// BodySample is one distinct response body seen with -hash-bodies, with the
+// number of responses that had it.
+type BodySample struct {
+    Hash      string `json:"hash"`
+    Count     int64  `json:"count"`
+    Body      string `json:"body"`
+    Truncated bool   `json:"truncated,omitempty"` // Body holds only the first maxBodySampleBytes
+}
+
+// BodyHashStats reports how many distinct bodies the responses of a
+// -hash-bodies run had. Samples holds the first maxBodySamples of them, most
+// common first.
+type BodyHashStats struct {
+    Responses int64        `json:"responses"`
+    Distinct  int          `json:"distinct"`
+    Samples   []BodySample `json:"samples"`
+}
+
+// bodyDigest hashes a decoded response body as it is read, keeping its
+// first maxBodySampleBytes in case it turns out to be a new body.
+type bodyDigest struct {
+    h         hash.Hash64
+    head      []byte
+    truncated bool
+}
+
+func newBodyDigest() *bodyDigest {
+    return &bodyDigest{h: fnv.New64a()}
+}
+
+func (d *bodyDigest) Write(p []byte) (int, error) {
+    d.h.Write(p)
+    n := len(p)
+    if room := maxBodySampleBytes - len(d.head); n > room {
+        p, d.truncated = p[:room], true
+    }
+    d.head = append(d.head, p...)
+    return n, nil
+}
+
+// bodyHashes counts responses by the hash of their body.
+var bodyHashes struct {
+    mu      sync.Mutex
+    counts  map[uint64]int64
+    samples map[uint64]*bodyDigest
+}
+
+// recordBodyHash counts the body d was written with.
+func recordBodyHash(d *bodyDigest) {
+    sum := d.h.Sum64()
+    bodyHashes.mu.Lock()
+    defer bodyHashes.mu.Unlock()
+    if bodyHashes.counts == nil {
+        bodyHashes.counts = make(map[uint64]int64)
+        bodyHashes.samples = make(map[uint64]*bodyDigest)
+    }
+    if _, seen := bodyHashes.counts[sum]; !seen && len(bodyHashes.samples) < maxBodySamples {
+        bodyHashes.samples[sum] = d
+    }
+    bodyHashes.counts[sum]++
+}
+
+// bodyHashStats summarizes the -hash-bodies counts, or returns nil when no
+// body was hashed.
+func bodyHashStats() *BodyHashStats {
+    bodyHashes.mu.Lock()
+    defer bodyHashes.mu.Unlock()
+    if len(bodyHashes.counts) == 0 {
+        return nil
+    }
+    stats := &BodyHashStats{Distinct: len(bodyHashes.counts)}
+    for _, n := range bodyHashes.counts {
+        stats.Responses += n
+    }
+    for sum, d := range bodyHashes.samples {
+        stats.Samples = append(stats.Samples, BodySample{
+            Hash:      fmt.Sprintf("%016x", sum),
+            Count:     bodyHashes.counts[sum],
+            Body:      string(d.head),
+            Truncated: d.truncated,
+        })
+    }
+    sort.Slice(stats.Samples, func(i, j int) bool {
+        a, b := stats.Samples[i], stats.Samples[j]
+        if a.Count != b.Count {
+            return a.Count > b.Count
+        }
+        return a.Hash < b.Hash
+    })
+    return stats
+}
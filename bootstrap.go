@@ -0,0 +1,106 @@
+package main
+
+import (
+	"math"
+	"runtime"
+	"sort"
+	"sync"
+	"time"
+)
+
+// bootstrapPercentiles are the percentiles -bootstrap puts an interval
+// around, the same ones the results report.
+var bootstrapPercentiles = []float64{50, 75, 90, 95, 99, 99.9}
+
+// PercentileCI is the confidence interval of one percentile.
+type PercentileCI struct {
+    Percentile float64       `json:"percentile"`
+    Low        time.Duration `json:"low"`
+    High       time.Duration `json:"high"`
+}
+
+// ConfidenceIntervals holds the -bootstrap intervals of a run, at Level
+// percent confidence from Resamples resamples of its response times.
+type ConfidenceIntervals struct {
+    Level       float64        `json:"level"`
+    Resamples   int            `json:"resamples"`
+    Percentiles []PercentileCI `json:"percentiles"`
+}
+
+// interval returns the confidence interval of percentile p, if it was
+// computed.
+func (c *ConfidenceIntervals) interval(p float64) (PercentileCI, bool) {
+    if c != nil {
+        for _, ci := range c.Percentiles {
+            if ci.Percentile == p {
+                return ci, true
+            }
+        }
+    }
+    return PercentileCI{}, false
+}
+
+// bootstrapIntervals estimates how much each of bootstrapPercentiles could
+// move by chance, by computing it over resamples random resamples of sorted
+// drawn with replacement, and taking the central level percent of the
+// results. Resample i is drawn from its own random stream, so a -seed replay
+// gives the same intervals however many CPUs share the work.
+func bootstrapIntervals(sorted []time.Duration, resamples int, level float64) *ConfidenceIntervals {
+    n := len(sorted)
+    estimates := make([][]time.Duration, len(bootstrapPercentiles))
+    for j := range estimates {
+        estimates[j] = make([]time.Duration, resamples)
+    }
+
+    // Since sorted is sorted, a resample is fully described by how many
+    // times each index was drawn, and its percentiles can be read off the
+    // running total of those counts without sorting
+    next := make(chan int)
+    var wg sync.WaitGroup
+    for g := 0; g < runtime.NumCPU(); g++ {
+        wg.Add(1)
+        go func() {
+            defer wg.Done()
+            counts := make([]int32, n)
+            for i := range next {
+                for k := range counts {
+                    counts[k] = 0
+                }
+                rng := newRand(-1 - int64(i))
+                for k := 0; k < n; k++ {
+                    counts[rng.Intn(n)]++
+                }
+                var seen int
+                idx := 0
+                for j, p := range bootstrapPercentiles {
+                    rank := int(math.Ceil(p/100*float64(n))) - 1
+                    if rank < 0 {
+                        rank = 0
+                    }
+                    for seen+int(counts[idx]) <= rank {
+                        seen += int(counts[idx])
+                        idx++
+                    }
+                    estimates[j][i] = sorted[idx]
+                }
+            }
+        }()
+    }
+    for i := 0; i < resamples; i++ {
+        next <- i
+    }
+    close(next)
+    wg.Wait()
+
+    ci := &ConfidenceIntervals{Level: level, Resamples: resamples}
+    tail := (100 - level) / 2
+    for j, p := range bootstrapPercentiles {
+        sort.Slice(estimates[j], func(a, b int) bool { return estimates[j][a] < estimates[j][b] })
+        ci.Percentiles = append(ci.Percentiles, PercentileCI{
+            Percentile: p,
+            Low:        computePercentile(estimates[j], tail),
+            High:       computePercentile(estimates[j], 100-tail),
+        })
+    }
+    return ci
+}
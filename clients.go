@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// simClient is one of the -client-count simulated clients. Each has its own
+// transport, and so its own connection pool, and its own cookie jar, and is
+// shared by the workers assigned to it.
+type simClient struct {
+    id     int // 1 for the first client
+    client *http.Client
+}
+
+// maxClientLines is the most -client-count clients the text results list
+// one by one; the JSON results always include them all.
+const maxClientLines = 20
+
+// simClients holds the -client-count clients, or nil when every worker uses
+// the shared client.
+var simClients []*simClient
+
+// ClientStats counts the requests of one -client-count client.
+type ClientStats struct {
+    Requests int64 `json:"requests"`
+    Failed   int64 `json:"failed"`
+}
+
+// sourceIPFlags collects the -source-ips addresses.
+type sourceIPFlags []net.IP
+
+func (s *sourceIPFlags) String() string {
+    ips := make([]string, len(*s))
+    for i, ip := range *s {
+        ips[i] = ip.String()
+    }
+    return strings.Join(ips, ",")
+}
+
+func (s *sourceIPFlags) Set(value string) error {
+    for _, field := range strings.Split(value, ",") {
+        ip := net.ParseIP(strings.TrimSpace(field))
+        if ip == nil {
+            return fmt.Errorf("invalid IP address %q", field)
+        }
+        *s = append(*s, ip)
+    }
+    return nil
+}
+
+var sourceIPs sourceIPFlags
+
+// dialFrom returns a dial function like dialContext whose connections come
+// from the local address ip.
+func dialFrom(ip net.IP) func(ctx context.Context, network, addr string) (net.Conn, error) {
+    d := *dialer
+    d.LocalAddr = &net.TCPAddr{IP: ip}
+    return func(ctx context.Context, network, addr string) (net.Conn, error) {
+        if pinned, ok := resolveOverrides[addr]; ok {
+            addr = pinned
+        }
+        return d.DialContext(ctx, network, addr)
+    }
+}
+
+// newSimClients builds n clients, each with a transport of its own and a
+// cookie jar seeded like a -cookies worker's. With -source-ips the clients
+// take the addresses in turn.
+func newSimClients(n int) ([]*simClient, error) {
+    clients := make([]*simClient, n)
+    for i := range clients {
+        dial := dialContext
+        if len(sourceIPs) > 0 {
+            dial = dialFrom(sourceIPs[i%len(sourceIPs)])
+        }
+        transport, err := buildTransport(dial)
+        if err != nil {
+            return nil, err
+        }
+        c := newSessionClient()
+        c.Transport = transport
+        clients[i] = &simClient{id: i + 1, client: c}
+    }
+    return clients, nil
+}
+
+// clientFor returns the client of worker n, spreading the workers evenly
+// over the clients, or nil without -client-count.
+func clientFor(n int) *simClient {
+    if len(simClients) == 0 {
+        return nil
+    }
+    return simClients[n%len(simClients)]
+}
+
+// clientStats counts the requests of each -client-count client, or returns
+// nil without it.
+func clientStats(samples []sample) []ClientStats {
+    if len(simClients) == 0 {
+        return nil
+    }
+    stats := make([]ClientStats, len(simClients))
+    for _, s := range samples {
+        if s.Client == 0 {
+            continue
+        }
+        cs := &stats[s.Client-1]
+        cs.Requests++
+        if s.Err != nil || s.Failed {
+            cs.Failed++
+        }
+    }
+    return stats
+}
+
+// checkClients validates -client-count and -source-ips against the other
+// flags.
+func checkClients() error {
+    switch {
+    case *clientCount < 0:
+        return fmt.Errorf("Invalid -client-count (expected 0 or more): %v", *clientCount)
+    case *clientCount == 0 && len(sourceIPs) > 0:
+        return errors.New("-source-ips assigns addresses to clients and needs -client-count")
+    case *clientCount == 0:
+        return nil
+    case *protocol != "http" || *pipeline > 0:
+        return errors.New("-client-count is only supported with -protocol http and without -pipeline")
+    case *useCookies:
+        return errors.New("-client-count gives each client its own cookie jar and cannot be used with -cookies")
+    }
+    return nil
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+    "encoding/json"
+    "fmt"
+    "os"
+    "strings"
+    "text/tabwriter"
+    "time"
+)
+
+// compareRuns loads two JSON results written with -output json and prints
+// the change in mean, p99 and throughput between them. A metric regresses
+// when it moves in the wrong direction by more than thresholdPct percent.
+// It returns the process exit code: 0 when nothing regressed, 1 otherwise.
+func compareRuns(oldFile, newFile string, thresholdPct float64) int {
+    oldResult, err := loadResult(oldFile)
+    if err != nil {
+        fmt.Println("Error reading results:", err)
+        return 1
+    }
+    newResult, err := loadResult(newFile)
+    if err != nil {
+        fmt.Println("Error reading results:", err)
+        return 1
+    }
+
+    metrics := []struct {
+        name           string
+        old, new       float64
+        format         func(float64) string
+        higherIsBetter bool
+    }{
+        {"Mean", float64(oldResult.Mean), float64(newResult.Mean), formatNanos, false},
+        {"99th Percentile", float64(oldResult.P99), float64(newResult.P99), formatNanos, false},
+        {"Throughput", oldResult.Throughput, newResult.Throughput, formatRate, true},
+    }
+
+    fmt.Printf("Comparing %s (old) with %s (new), threshold %.1f%%\n\n", oldFile, newFile, thresholdPct)
+
+    w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+    fmt.Fprintln(w, "Metric\tOld\tNew\tChange\tStatus")
+    var regressions []string
+    for _, m := range metrics {
+        change := 0.0
+        if m.old != 0 {
+            change = (m.new - m.old) / m.old * 100
+        }
+
+        worse := change > thresholdPct
+        if m.higherIsBetter {
+            worse = -change > thresholdPct
+        }
+        status := "ok"
+        if worse {
+            status = "REGRESSION"
+            regressions = append(regressions, m.name)
+        }
+
+        fmt.Fprintf(w, "%s\t%s\t%s\t%+.2f%%\t%s\n", m.name, m.format(m.old), m.format(m.new), change, status)
+    }
+    w.Flush()
+
+    // With -bootstrap intervals on both sides, say whether the p99 change
+    // stands out from sampling noise
+    oldCI, okOld := oldResult.Confidence.interval(99)
+    newCI, okNew := newResult.Confidence.interval(99)
+    if okOld && okNew {
+        verdict := "they overlap, so the change may be noise"
+        if oldCI.High < newCI.Low || newCI.High < oldCI.Low {
+            verdict = "they don't overlap, so the change is unlikely to be noise"
+        }
+        fmt.Printf("\n99th percentile confidence intervals: old %v to %v, new %v to %v; %s\n",
+            oldCI.Low, oldCI.High, newCI.Low, newCI.High, verdict)
+    }
+
+    if len(regressions) > 0 {
+        fmt.Printf("\nFAIL: %s regressed by more than %.1f%%\n", strings.Join(regressions, ", "), thresholdPct)
+        return 1
+    }
+    fmt.Printf("\nPASS: no metric regressed by more than %.1f%%\n", thresholdPct)
+    return 0
+}
+
+// loadResult reads a Result previously written with -output json.
+func loadResult(filename string) (Result, error) {
+    var r Result
+    data, err := os.ReadFile(filename)
+    if err != nil {
+        return r, err
+    }
+    if err := json.Unmarshal(data, &r); err != nil {
+        return r, fmt.Errorf("%s: %v", filename, err)
+    }
+    return r, nil
+}
+
+func formatNanos(v float64) string {
+    return time.Duration(v).String()
+}
+
+func formatRate(v float64) string {
+    return fmt.Sprintf("%.2f req/s", v)
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Config is a benchmark scenario read from a -config file. Keys are the flag
+// names, so a scenario reads like the command line it replaces. Every field
+// is optional: a key left out keeps the flag's default, and a flag given
+// explicitly on the command line overrides the file.
+//
+// Durations are written as the flags take them, e.g. "30s". The header,
+// cookie, form, form-file and resolve lists correspond to the repeatable -H,
+// -cookie, -form, -form-file and -resolve flags.
+type Config struct {
+    Server           *string  `json:"server" yaml:"server"`
+    URLsFile         *string  `json:"urls-file" yaml:"urls-file"`
+    URLOrder         *string  `json:"url-order" yaml:"url-order"`
+    Protocol         *string  `json:"protocol" yaml:"protocol"`
+    GRPCMethod       *string  `json:"grpc-method" yaml:"grpc-method"`
+    Concurrency      *int     `json:"concurrency" yaml:"concurrency"`
+    Duration         *string  `json:"duration" yaml:"duration"`
+    Requests         *int64   `json:"requests" yaml:"requests"`
+    Repeat           *int     `json:"repeat" yaml:"repeat"`
+    Cooldown         *string  `json:"cooldown" yaml:"cooldown"`
+    FindKnee         *bool    `json:"find-knee" yaml:"find-knee"`
+    KneeStep         *string  `json:"knee-step" yaml:"knee-step"`
+    KneeGain         *float64 `json:"knee-gain" yaml:"knee-gain"`
+    MaxConcurrency   *int     `json:"max-concurrency" yaml:"max-concurrency"`
+    KneeCSV          *string  `json:"knee-csv" yaml:"knee-csv"`
+    Window           *string  `json:"window" yaml:"window"`
+    Seed             *int64   `json:"seed" yaml:"seed"`
+    AutoStop         *bool    `json:"auto-stop" yaml:"auto-stop"`
+    StabilityThresh  *float64 `json:"stability-threshold" yaml:"stability-threshold"`
+    StabilityWindow  *string  `json:"stability-window" yaml:"stability-window"`
+    StabilityWindows *int     `json:"stability-windows" yaml:"stability-windows"`
+    Rate             *float64 `json:"rate" yaml:"rate"`
+    ArrivalRate      *float64 `json:"arrival-rate" yaml:"arrival-rate"`
+    MaxInflight      *int     `json:"max-inflight" yaml:"max-inflight"`
+    MaxRPS           *float64 `json:"max-rps" yaml:"max-rps"`
+    Pipeline         *int     `json:"pipeline" yaml:"pipeline"`
+    ThinkTime        *string  `json:"think-time" yaml:"think-time"`
+    ThinkJitter      *string  `json:"think-jitter" yaml:"think-jitter"`
+    RampUp           *string  `json:"ramp-up" yaml:"ramp-up"`
+    Warmup           *string  `json:"warmup" yaml:"warmup"`
+    WarmupRequests   *int     `json:"warmup-requests" yaml:"warmup-requests"`
+    Timeout          *string  `json:"timeout" yaml:"timeout"`
+    DrainTimeout     *string  `json:"drain-timeout" yaml:"drain-timeout"`
+    BodyLimit        *int64   `json:"body-limit" yaml:"body-limit"`
+    FailFast         *bool    `json:"fail-fast" yaml:"fail-fast"`
+    WaitForServer    *string  `json:"wait-for-server" yaml:"wait-for-server"`
+    Mode             *string  `json:"mode" yaml:"mode"`
+    BurstDuration    *string  `json:"burst-duration" yaml:"burst-duration"`
+    BurstConcurrency *int     `json:"burst-concurrency" yaml:"burst-concurrency"`
+    RestDuration     *string  `json:"rest-duration" yaml:"rest-duration"`
+    Method           *string  `json:"method" yaml:"method"`
+    MethodWeights    *string  `json:"method-weights" yaml:"method-weights"`
+    Header           []string `json:"header" yaml:"header" flag:"H"`
+    Headers          *string  `json:"headers" yaml:"headers"`
+    Payload          *string  `json:"payload" yaml:"payload"`
+    PayloadFile      *string  `json:"payload-file" yaml:"payload-file"`
+    PayloadDir       *string  `json:"payload-dir" yaml:"payload-dir"`
+    Template         *bool    `json:"template" yaml:"template"`
+    Script           *string  `json:"script" yaml:"script"`
+    StreamSize       *int64   `json:"stream-size" yaml:"stream-size"`
+    Form             []string `json:"form" yaml:"form"`
+    FormFile         []string `json:"form-file" yaml:"form-file"`
+    Cookie           []string `json:"cookie" yaml:"cookie"`
+    ClientCount      *int     `json:"client-count" yaml:"client-count"`
+    SourceIPs        *string  `json:"source-ips" yaml:"source-ips"`
+    Cookies          *bool    `json:"cookies" yaml:"cookies"`
+    BasicAuth        *string  `json:"basic-auth" yaml:"basic-auth"`
+    Bearer           *string  `json:"bearer" yaml:"bearer"`
+    Sign             *string  `json:"sign" yaml:"sign"`
+    SignRegion       *string  `json:"sign-region" yaml:"sign-region"`
+    SignService      *string  `json:"sign-service" yaml:"sign-service"`
+    SignSecret       *string  `json:"sign-secret" yaml:"sign-secret"`
+    Insecure         *bool    `json:"insecure" yaml:"insecure"`
+    TLSSessionCache  *bool    `json:"tls-session-cache" yaml:"tls-session-cache"`
+    CACert           *string  `json:"cacert" yaml:"cacert"`
+    Cert             *string  `json:"cert" yaml:"cert"`
+    Key              *string  `json:"key" yaml:"key"`
+    HTTP2            *bool    `json:"http2" yaml:"http2"`
+    HTTP2Only        *bool    `json:"http2-only" yaml:"http2-only"`
+    Proxy            *string  `json:"proxy" yaml:"proxy"`
+    Resolve          []string `json:"resolve" yaml:"resolve"`
+    FollowRedirects  *bool    `json:"follow-redirects" yaml:"follow-redirects"`
+    KeepAlive        *bool    `json:"keepalive" yaml:"keepalive"`
+    AcceptEncoding   *string  `json:"accept-encoding" yaml:"accept-encoding"`
+    Connections      *int     `json:"connections" yaml:"connections"`
+    MaxIdleConns     *int     `json:"max-idle-conns" yaml:"max-idle-conns"`
+    ExpectStatus     *int     `json:"expect-status" yaml:"expect-status"`
+    CaptureHeader    []string `json:"capture-header" yaml:"capture-header"`
+    HashBodies       *bool    `json:"hash-bodies" yaml:"hash-bodies"`
+    ExpectBodyRegex  *string  `json:"expect-body-regex" yaml:"expect-body-regex"`
+    SLAP99           *string  `json:"sla-p99" yaml:"sla-p99"`
+    SLAErrorRate     *string  `json:"sla-error-rate" yaml:"sla-error-rate"`
+    MaxErrors        *int64   `json:"max-errors" yaml:"max-errors"`
+    Output           *string  `json:"output" yaml:"output"`
+    OutputDir        *string  `json:"output-dir" yaml:"output-dir"`
+    Name             *string  `json:"name" yaml:"name"`
+    KeepSamples      *bool    `json:"keep-samples" yaml:"keep-samples"`
+    CSV              *string  `json:"csv" yaml:"csv"`
+    ThroughputCSV    *string  `json:"throughput-csv" yaml:"throughput-csv"`
+    RawOut           *string  `json:"raw-out" yaml:"raw-out"`
+    PrometheusOut    *string  `json:"prometheus-out" yaml:"prometheus-out"`
+    HdrOut           *string  `json:"hdr-out" yaml:"hdr-out"`
+    MetricsPort      *int     `json:"metrics-port" yaml:"metrics-port"`
+    HTML             *string  `json:"html" yaml:"html"`
+    Timeline         *bool    `json:"timeline" yaml:"timeline"`
+    PerCPU           *bool    `json:"per-cpu" yaml:"per-cpu"`
+    Bootstrap        *int     `json:"bootstrap" yaml:"bootstrap"`
+    Confidence       *float64 `json:"confidence" yaml:"confidence"`
+    Bins             *int     `json:"bins" yaml:"bins"`
+    LogScale         *bool    `json:"log-scale" yaml:"log-scale"`
+    TargetLatency    *string  `json:"target-latency" yaml:"target-latency"`
+    NoPlot           *bool    `json:"no-plot" yaml:"no-plot"`
+    Verbose          *bool    `json:"verbose" yaml:"verbose"`
+    VerboseErrs      *bool    `json:"verbose-errors-only" yaml:"verbose-errors-only"`
+}
+
+// loadConfig reads the scenario in filename, as JSON if it has a .json
+// extension and as YAML otherwise, and applies it to the flags that were
+// not set on the command line. Unknown keys are rejected so that a typo
+// doesn't silently fall back to a default.
+func loadConfig(filename string) error {
+    data, err := os.ReadFile(filename)
+    if err != nil {
+        return err
+    }
+
+    var cfg Config
+    if strings.EqualFold(filepath.Ext(filename), ".json") {
+        dec := json.NewDecoder(bytes.NewReader(data))
+        dec.DisallowUnknownFields()
+        err = dec.Decode(&cfg)
+    } else {
+        dec := yaml.NewDecoder(bytes.NewReader(data))
+        dec.KnownFields(true)
+        err = dec.Decode(&cfg)
+    }
+    if err != nil {
+        return fmt.Errorf("parsing %s: %v", filename, err)
+    }
+    return cfg.apply()
+}
+
+// commandLine holds the names of the flags given on the command line. It is
+// recorded by main right after flag.Parse, since flag.Visit also reports the
+// flags an earlier apply set, which a later config must still override.
+var commandLine = make(map[string]bool)
+
+// recordCommandLine fills in commandLine from the parsed flags.
+func recordCommandLine() {
+    flag.Visit(func(f *flag.Flag) { commandLine[f.Name] = true })
+}
+
+// apply sets each flag present in the config through flag.Set, so file
+// values are parsed and validated exactly like command-line ones. Flags
+// given explicitly on the command line are left alone.
+func (c *Config) apply() error {
+    v := reflect.ValueOf(c).Elem()
+    t := v.Type()
+    for i := 0; i < t.NumField(); i++ {
+        field := t.Field(i)
+        name := field.Tag.Get("flag")
+        if name == "" {
+            name = field.Tag.Get("yaml")
+        }
+        if commandLine[name] || v.Field(i).IsNil() {
+            continue
+        }
+
+        var values []string
+        if field.Type.Kind() == reflect.Slice {
+            values = v.Field(i).Interface().([]string)
+        } else {
+            values = []string{fmt.Sprint(v.Field(i).Elem().Interface())}
+        }
+        for _, value := range values {
+            if err := flag.Set(name, value); err != nil {
+                return fmt.Errorf("%s: %v", field.Tag.Get("yaml"), err)
+            }
+        }
+    }
+    return nil
+}
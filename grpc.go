@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"sync/atomic"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	grpcinsecure "google.golang.org/grpc/credentials/insecure"
+	rpb "google.golang.org/grpc/reflection/grpc_reflection_v1alpha"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+// newGRPCCall connects to the gRPC server at target and looks up fullMethod,
+// given as package.Service/Method, through server reflection. The returned
+// call invokes the method once with the payload decoded from JSON into the
+// request message, reporting the encoded request and response sizes.
+//
+// target is host:port, optionally prefixed with grpc:// for plaintext (the
+// default) or grpcs:// for TLS using the -insecure, -cacert, -cert and -key
+// settings.
+func newGRPCCall(target, fullMethod string) (callFunc, error) {
+    service, methodName, ok := strings.Cut(strings.TrimPrefix(fullMethod, "/"), "/")
+    if !ok || service == "" || methodName == "" {
+        return nil, fmt.Errorf("expected -grpc-method as package.Service/Method, got %q", fullMethod)
+    }
+
+    creds := grpcinsecure.NewCredentials()
+    if strings.HasPrefix(target, "grpcs://") {
+        tlsConfig, err := buildTLSConfig()
+        if err != nil {
+            return nil, err
+        }
+        creds = credentials.NewTLS(tlsConfig)
+    }
+    target = strings.TrimPrefix(strings.TrimPrefix(target, "grpcs://"), "grpc://")
+
+    conn, err := grpc.Dial(target,
+        grpc.WithTransportCredentials(creds),
+        grpc.WithContextDialer(func(ctx context.Context, addr string) (net.Conn, error) {
+            return dialContext(ctx, "tcp", addr)
+        }))
+    if err != nil {
+        return nil, err
+    }
+
+    ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+    defer cancel()
+    method, err := resolveMethod(ctx, conn, service, methodName)
+    if err != nil {
+        conn.Close()
+        return nil, err
+    }
+    if method.IsStreamingClient() || method.IsStreamingServer() {
+        conn.Close()
+        return nil, fmt.Errorf("%s is a streaming method; only unary methods are supported", fullMethod)
+    }
+
+    // A static payload is decoded once and shared; a templated one has to
+    // be rendered and decoded per call
+    newRequest := func() (proto.Message, error) {
+        data := payloadBytes
+        if payloadTemplate != nil {
+            vars := requestVars{Seq: atomic.AddUint64(&requestSeq, 1), Rand: sharedRand.Int63()}
+            rendered, err := renderTemplate(payloadTemplate, vars)
+            if err != nil {
+                return nil, err
+            }
+            data = rendered
+        }
+        req := dynamicpb.NewMessage(method.Input())
+        if len(data) > 0 {
+            if err := protojson.Unmarshal(data, req); err != nil {
+                return nil, fmt.Errorf("decoding payload as %s: %v", method.Input().FullName(), err)
+            }
+        }
+        return req, nil
+    }
+    if payloadTemplate == nil {
+        req, err := newRequest()
+        if err != nil {
+            conn.Close()
+            return nil, err
+        }
+        newRequest = func() (proto.Message, error) { return req, nil }
+    }
+
+    path := "/" + service + "/" + methodName
+    return func(ctx context.Context) (int64, int64, error) {
+        req, err := newRequest()
+        if err != nil {
+            return 0, 0, err
+        }
+        resp := dynamicpb.NewMessage(method.Output())
+        if err := conn.Invoke(ctx, path, req, resp); err != nil {
+            return int64(proto.Size(req)), 0, err
+        }
+        return int64(proto.Size(req)), int64(proto.Size(resp)), nil
+    }, nil
+}
+
+// resolveMethod fetches the file defining service, and every file it
+// imports, from the server's reflection service and returns the descriptor
+// of the named method.
+func resolveMethod(ctx context.Context, conn *grpc.ClientConn, service, methodName string) (protoreflect.MethodDescriptor, error) {
+    stream, err := rpb.NewServerReflectionClient(conn).ServerReflectionInfo(ctx)
+    if err != nil {
+        return nil, err
+    }
+    defer stream.CloseSend()
+
+    files := make(map[string]*descriptorpb.FileDescriptorProto)
+    var order []*descriptorpb.FileDescriptorProto
+    fetch := func(req *rpb.ServerReflectionRequest) error {
+        if err := stream.Send(req); err != nil {
+            return err
+        }
+        resp, err := stream.Recv()
+        if err != nil {
+            return err
+        }
+        if e := resp.GetErrorResponse(); e != nil {
+            return fmt.Errorf("reflection: %s", e.GetErrorMessage())
+        }
+        for _, raw := range resp.GetFileDescriptorResponse().GetFileDescriptorProto() {
+            fd := &descriptorpb.FileDescriptorProto{}
+            if err := proto.Unmarshal(raw, fd); err != nil {
+                return err
+            }
+            if _, ok := files[fd.GetName()]; !ok {
+                files[fd.GetName()] = fd
+                order = append(order, fd)
+            }
+        }
+        return nil
+    }
+
+    err = fetch(&rpb.ServerReflectionRequest{
+        MessageRequest: &rpb.ServerReflectionRequest_FileContainingSymbol{FileContainingSymbol: service},
+    })
+    if err != nil {
+        return nil, err
+    }
+
+    // Servers may leave out imports they assume the client already has, so
+    // ask for any that are missing by name
+    for i := 0; i < len(order); i++ {
+        for _, dep := range order[i].GetDependency() {
+            if _, ok := files[dep]; ok {
+                continue
+            }
+            err := fetch(&rpb.ServerReflectionRequest{
+                MessageRequest: &rpb.ServerReflectionRequest_FileByFilename{FileByFilename: dep},
+            })
+            if err != nil {
+                return nil, err
+            }
+        }
+    }
+
+    registry, err := protodesc.NewFiles(&descriptorpb.FileDescriptorSet{File: order})
+    if err != nil {
+        return nil, err
+    }
+    desc, err := registry.FindDescriptorByName(protoreflect.FullName(service))
+    if err != nil {
+        return nil, err
+    }
+    sd, ok := desc.(protoreflect.ServiceDescriptor)
+    if !ok {
+        return nil, fmt.Errorf("%s is not a service", service)
+    }
+    md := sd.Methods().ByName(protoreflect.Name(methodName))
+    if md == nil {
+        return nil, fmt.Errorf("service %s has no method %s", service, methodName)
+    }
+    return md, nil
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	hdrhistogram "github.com/HdrHistogram/hdrhistogram-go"
+)
+
+// hdrMax is the longest response time the HdrHistogram tracks; longer
+// ones are recorded as this.
+const hdrMax = int64(time.Hour)
+
+// latencyHdr records every measured response time, in nanoseconds, for
+// -hdr-out and the status line's running p99.
+var latencyHdr = struct {
+    mu sync.Mutex
+    h  *hdrhistogram.Histogram
+}{h: newLatencyHistogram()}
+
+// newLatencyHistogram returns a histogram of response times in nanoseconds,
+// from 1µs to hdrMax, to three significant figures.
+func newLatencyHistogram() *hdrhistogram.Histogram {
+    return hdrhistogram.New(int64(time.Microsecond), hdrMax, 3)
+}
+
+// recordLatency adds d to a histogram from newLatencyHistogram, clamped to
+// its range.
+func recordLatency(h *hdrhistogram.Histogram, d time.Duration) {
+    v := int64(d)
+    if v < 1 {
+        v = 1
+    } else if v > hdrMax {
+        v = hdrMax
+    }
+    h.RecordValue(v)
+}
+
+// recordHdr adds a response time to latencyHdr. With neither -hdr-out nor
+// the status line nothing reads it, so workers don't take its lock.
+func recordHdr(d time.Duration) {
+    if *hdrOut == "" && !showProgress {
+        return
+    }
+    latencyHdr.mu.Lock()
+    recordLatency(latencyHdr.h, d)
+    latencyHdr.mu.Unlock()
+}
+
+// resetHdr clears latencyHdr between runs.
+func resetHdr() {
+    latencyHdr.mu.Lock()
+    latencyHdr.h.Reset()
+    latencyHdr.mu.Unlock()
+}
+
+// saveHdr writes latencyHdr to -hdr-out, if set. A .hgrm file gets the
+// percentile distribution in milliseconds, as read by hdr-plot; any other
+// name gets HdrHistogram's compressed log, holding the measurement from
+// start to end as one interval, as read by HistogramLogProcessor.
+func saveHdr(start, end time.Time) {
+    if *hdrOut == "" {
+        return
+    }
+    filename := artifactPath(*hdrOut)
+    latencyHdr.mu.Lock()
+    defer latencyHdr.mu.Unlock()
+    if err := writeHdr(filename, latencyHdr.h, start, end); err != nil {
+        fmt.Fprintln(logOut, "Error writing HdrHistogram:", err)
+        return
+    }
+    fmt.Fprintf(logOut, "Saved HdrHistogram of %d response times to %s\n", latencyHdr.h.TotalCount(), filename)
+}
+
+func writeHdr(filename string, h *hdrhistogram.Histogram, start, end time.Time) error {
+    f, err := os.Create(filename)
+    if err != nil {
+        return err
+    }
+    defer f.Close()
+
+    w := bufio.NewWriter(f)
+    if strings.EqualFold(filepath.Ext(filename), ".hgrm") {
+        _, err = h.PercentilesPrint(w, 5, float64(time.Millisecond))
+    } else {
+        err = writeHdrLog(w, h, start, end)
+    }
+    if err != nil {
+        return err
+    }
+    if err := w.Flush(); err != nil {
+        return err
+    }
+    return f.Close()
+}
+
+// writeHdrLog writes h as a histogram log. The library's own interval line
+// gives the end time where the format has the interval length, so the line
+// is written here.
+func writeHdrLog(w io.Writer, h *hdrhistogram.Histogram, start, end time.Time) error {
+    payload, err := h.Encode(hdrhistogram.V2CompressedEncodingCookieBase)
+    if err != nil {
+        return err
+    }
+    lw := hdrhistogram.NewHistogramLogWriter(w)
+    if err := lw.OutputLogFormatVersion(); err != nil {
+        return err
+    }
+    if err := lw.OutputStartTime(start.UnixNano() / int64(time.Millisecond)); err != nil {
+        return err
+    }
+    if err := lw.OutputLegend(); err != nil {
+        return err
+    }
+    // Timestamps are in seconds from the start time, and the maximum in
+    // milliseconds, as in the Java implementation's logs
+    _, err = fmt.Fprintf(w, "%.3f,%.3f,%.3f,%s\n", 0.0, end.Sub(start).Seconds(),
+        float64(h.Max())/float64(time.Millisecond), payload)
+    return err
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// inFlightSampleInterval is how often the number of requests in flight is
+// sampled.
+const inFlightSampleInterval = 10 * time.Millisecond
+
+// inFlight is the number of requests sent and not yet answered, across all
+// workers.
+var inFlight int64
+
+// ConcurrencyStats compares the concurrency a run was configured with to the
+// number of requests actually in flight, sampled every
+// inFlightSampleInterval over the measurement window. Think time, -rate and
+// a slow ramp-up all keep the achieved concurrency below the configured one.
+type ConcurrencyStats struct {
+    Configured int     `json:"configured"` // -concurrency, or -max-inflight with -arrival-rate
+    Mean       float64 `json:"mean"`
+    Max        int64   `json:"max"`
+}
+
+// sampleInFlight samples inFlight from measureStart until the returned
+// function is called, which returns the statistics, or nil when no sample
+// was taken.
+func sampleInFlight(configured int, measureStart time.Time) (stop func() *ConcurrencyStats) {
+    done := make(chan struct{})
+    result := make(chan *ConcurrencyStats, 1)
+    go func() {
+        var sum, max, samples int64
+        ticker := time.NewTicker(inFlightSampleInterval)
+        defer ticker.Stop()
+        for {
+            select {
+            case now := <-ticker.C:
+                if now.Before(measureStart) {
+                    continue
+                }
+                n := atomic.LoadInt64(&inFlight)
+                sum += n
+                samples++
+                if n > max {
+                    max = n
+                }
+            case <-done:
+                if samples == 0 {
+                    result <- nil
+                    return
+                }
+                result <- &ConcurrencyStats{Configured: configured, Mean: float64(sum) / float64(samples), Max: max}
+                return
+            }
+        }
+    }()
+    return func() *ConcurrencyStats {
+        close(done)
+        return <-result
+    }
+}
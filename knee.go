@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+)
+
+// KneeStep is one concurrency level of a -find-knee sweep.
+type KneeStep struct {
+    Concurrency int           `json:"concurrency"`
+    Throughput  float64       `json:"throughput"`
+    Median      time.Duration `json:"median"`
+    P99         time.Duration `json:"p99"`
+    Failed      int64         `json:"failed_requests"`
+}
+
+// KneeResult is the outcome of a -find-knee sweep. Knee is the concurrency
+// past which adding workers stopped paying off, and Saturated is false when
+// the sweep reached -max-concurrency before finding it.
+type KneeResult struct {
+    Steps     []KneeStep `json:"steps"`
+    Knee      int        `json:"knee"`
+    Saturated bool       `json:"saturated"`
+}
+
+// runKneeSearch doubles the concurrency from 1, running each level for
+// -knee-step, until doubling no longer raises the throughput by -knee-gain
+// percent or more than doubles the p99. The knee is the last level before
+// that. Each level is a run of its own, like a -repeat run, and an
+// interrupt stops the sweep after the level in progress.
+func runKneeSearch(ctx context.Context, runner *Runner) {
+    var summary KneeResult
+    *duration, *totalRequests = *kneeStep, 0
+    for c, i := 1, 1; c <= *maxConcurrency && ctx.Err() == nil; c, i = c*2, i+1 {
+        if i > 1 {
+            select {
+            case <-time.After(*cooldown):
+            case <-ctx.Done():
+            }
+            if ctx.Err() != nil {
+                break
+            }
+        }
+        *concurrency = c
+        if err := runner.prepare(); err != nil {
+            fmt.Fprintln(logOut, "Error preparing run:", err)
+            exitCode = 1
+            break
+        }
+
+        repeatRun = i
+        fmt.Fprintf(logOut, "\nConcurrency %d\n", c)
+        result, err := runner.run(ctx)
+        if err != nil {
+            // A level where nothing succeeds is past any knee
+            fmt.Fprintf(logOut, "Concurrency %d failed: %v\n", c, err)
+            summary.Saturated = true
+            break
+        }
+        step := KneeStep{Concurrency: c, Throughput: result.Throughput, Median: result.Median, P99: result.P99, Failed: result.FailedRequests}
+        fmt.Fprintf(logOut, "Concurrency %d: %.2f requests/second, median %v, p99 %v, %d failed\n",
+            c, step.Throughput, step.Median, step.P99, step.Failed)
+        summary.Steps = append(summary.Steps, step)
+
+        if n := len(summary.Steps); n > 1 {
+            prev := summary.Steps[n-2]
+            if step.Throughput < prev.Throughput*(1+*kneeGain/100) || step.P99 > 2*prev.P99 {
+                summary.Saturated = true
+                break
+            }
+        }
+    }
+    repeatRun = 0
+
+    if len(summary.Steps) == 0 {
+        fmt.Fprintln(logOut, "\nNo concurrency level completed, cannot find the knee")
+        exitCode = 1
+        return
+    }
+    knee := summary.Steps[len(summary.Steps)-1]
+    if summary.Saturated && len(summary.Steps) > 1 {
+        knee = summary.Steps[len(summary.Steps)-2]
+    }
+    summary.Knee = knee.Concurrency
+
+    filename := artifactPath(artifactName(*kneeCSV))
+    if err := writeKneeCSV(summary.Steps, filename); err != nil {
+        fmt.Fprintln(logOut, "Error writing knee CSV:", err)
+    } else {
+        fmt.Fprintf(logOut, "Saved concurrency sweep to %s\n", filename)
+    }
+
+    if *output == "json" {
+        enc := json.NewEncoder(os.Stdout)
+        enc.SetIndent("", "  ")
+        if err := enc.Encode(summary); err != nil {
+            fmt.Fprintln(os.Stderr, "Error encoding results:", err)
+        }
+        return
+    }
+    fmt.Printf("\nConcurrency Sweep:\n")
+    for _, s := range summary.Steps {
+        fmt.Printf("%d workers: %.2f requests/second, median %v, p99 %v, %d failed\n",
+            s.Concurrency, s.Throughput, s.Median, s.P99, s.Failed)
+    }
+    if summary.Saturated {
+        fmt.Printf("Knee: %d workers, %.2f requests/second at p99 %v\n", knee.Concurrency, knee.Throughput, knee.P99)
+    } else {
+        fmt.Printf("No knee up to %d workers: throughput was still rising (%.2f requests/second at p99 %v)\n",
+            knee.Concurrency, knee.Throughput, knee.P99)
+    }
+}
+
+// writeKneeCSV writes one row per concurrency level of the sweep.
+func writeKneeCSV(steps []KneeStep, filename string) error {
+    f, err := os.Create(filename)
+    if err != nil {
+        return err
+    }
+    defer f.Close()
+
+    w := csv.NewWriter(f)
+    w.Write([]string{"concurrency", "throughput", "median_ms", "p99_ms", "failed"})
+    for _, s := range steps {
+        w.Write([]string{
+            strconv.Itoa(s.Concurrency),
+            strconv.FormatFloat(s.Throughput, 'f', 2, 64),
+            strconv.FormatFloat(float64(s.Median)/float64(time.Millisecond), 'f', 3, 64),
+            strconv.FormatFloat(float64(s.P99)/float64(time.Millisecond), 'f', 3, 64),
+            strconv.FormatInt(s.Failed, 10),
+        })
+    }
+    w.Flush()
+    if err := w.Error(); err != nil {
+        return err
+    }
+    return f.Close()
+}
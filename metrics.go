@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// latencyBuckets are the upper bounds, in seconds, of the response time
+// histogram exported in Prometheus format. They follow the Prometheus client
+// defaults with finer steps at the low end, where most services answer.
+var latencyBuckets = [...]float64{0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// latencyHistogram counts completed response times per bucket as they
+// arrive, so the metrics can be scraped while the run is going. The last
+// count is for responses slower than every bucket.
+var latencyHistogram struct {
+    counts [len(latencyBuckets) + 1]int64
+    sum    int64 // nanoseconds
+}
+
+// observeLatency adds a completed response time to latencyHistogram.
+func observeLatency(d time.Duration) {
+    seconds := d.Seconds()
+    i := sort.Search(len(latencyBuckets), func(i int) bool { return seconds <= latencyBuckets[i] })
+    atomic.AddInt64(&latencyHistogram.counts[i], 1)
+    atomic.AddInt64(&latencyHistogram.sum, int64(d))
+}
+
+// resetMetrics clears latencyHistogram between runs.
+func resetMetrics() {
+    for i := range latencyHistogram.counts {
+        atomic.StoreInt64(&latencyHistogram.counts[i], 0)
+    }
+    atomic.StoreInt64(&latencyHistogram.sum, 0)
+}
+
+// writeMetrics writes the run's counters and response time histogram in the
+// Prometheus text exposition format.
+func writeMetrics(w io.Writer) error {
+    bw := bufio.NewWriter(w)
+    counter := func(name, help string, value int64) {
+        fmt.Fprintf(bw, "# HELP %s %s\n# TYPE %s counter\n%s %d\n", name, help, name, name, value)
+    }
+
+    fmt.Fprintf(bw, "# HELP benchmark_requests_total Requests recorded, by outcome.\n# TYPE benchmark_requests_total counter\n")
+    fmt.Fprintf(bw, "benchmark_requests_total{outcome=\"success\"} %d\n", atomic.LoadInt64(&successfulRequests))
+    fmt.Fprintf(bw, "benchmark_requests_total{outcome=\"failure\"} %d\n", atomic.LoadInt64(&failedRequests))
+    counter("benchmark_timeouts_total", "Requests that timed out, also counted as failures.", atomic.LoadInt64(&timeoutRequests))
+    counter("benchmark_validation_failures_total", "Responses rejected by -expect-status or -expect-body-regex.", atomic.LoadInt64(&validationFailures))
+
+    fmt.Fprintf(bw, "# HELP benchmark_responses_total Responses received, by status class.\n# TYPE benchmark_responses_total counter\n")
+    for class := 1; class < len(statusClasses); class++ {
+        fmt.Fprintf(bw, "benchmark_responses_total{class=\"%dxx\"} %d\n", class, atomic.LoadInt64(&statusClasses[class]))
+    }
+
+    counts := errorCounts()
+    fmt.Fprintf(bw, "# HELP benchmark_errors_total Failed requests, by error category.\n# TYPE benchmark_errors_total counter\n")
+    for _, kind := range keysByCount(counts) {
+        fmt.Fprintf(bw, "benchmark_errors_total{kind=%s} %d\n", strconv.Quote(kind), counts[kind])
+    }
+
+    counter("benchmark_bytes_sent_total", "Request body bytes sent.", atomic.LoadInt64(&bytesSent))
+    counter("benchmark_bytes_received_total", "Response body bytes received.", atomic.LoadInt64(&bytesReceived))
+
+    fmt.Fprintf(bw, "# HELP benchmark_response_time_seconds Response times of completed requests.\n# TYPE benchmark_response_time_seconds histogram\n")
+    var cumulative int64
+    for i, le := range latencyBuckets {
+        cumulative += atomic.LoadInt64(&latencyHistogram.counts[i])
+        fmt.Fprintf(bw, "benchmark_response_time_seconds_bucket{le=\"%s\"} %d\n", strconv.FormatFloat(le, 'g', -1, 64), cumulative)
+    }
+    cumulative += atomic.LoadInt64(&latencyHistogram.counts[len(latencyBuckets)])
+    fmt.Fprintf(bw, "benchmark_response_time_seconds_bucket{le=\"+Inf\"} %d\n", cumulative)
+    fmt.Fprintf(bw, "benchmark_response_time_seconds_sum %s\n",
+        strconv.FormatFloat(time.Duration(atomic.LoadInt64(&latencyHistogram.sum)).Seconds(), 'g', -1, 64))
+    fmt.Fprintf(bw, "benchmark_response_time_seconds_count %d\n", cumulative)
+    return bw.Flush()
+}
+
+// serveMetrics serves writeMetrics at /metrics on -metrics-port for the
+// rest of the process, so a soak test can be scraped while it runs.
+func serveMetrics(port int) error {
+    ln, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+    if err != nil {
+        return err
+    }
+    mux := http.NewServeMux()
+    mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+        w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+        writeMetrics(w)
+    })
+    go http.Serve(ln, mux)
+    fmt.Fprintf(logOut, "Serving metrics at http://%s/metrics\n", ln.Addr())
+    return nil
+}
+
+// savePrometheus writes the metrics at the end of a run to -prometheus-out,
+// if set.
+func savePrometheus() {
+    if *prometheusOut == "" {
+        return
+    }
+    filename := artifactPath(*prometheusOut)
+    f, err := os.Create(filename)
+    if err == nil {
+        err = writeMetrics(f)
+        if closeErr := f.Close(); err == nil {
+            err = closeErr
+        }
+    }
+    if err != nil {
+        fmt.Fprintln(logOut, "Error writing Prometheus metrics:", err)
+        return
+    }
+    fmt.Fprintf(logOut, "Saved Prometheus metrics to %s\n", filename)
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync/atomic"
+)
+
+// maxPayloadDirBytes caps the total size of the files -payload-dir loads, as
+// they are all held in memory for the whole run.
+const maxPayloadDirBytes = 256 << 20
+
+// dirPayload is one file loaded by -payload-dir.
+type dirPayload struct {
+    data []byte
+    sent int32 // set once the payload has been sent
+}
+
+// dirPayloads holds the -payload-dir files, sorted by name so that a -seed
+// picks the same files on a replay.
+var dirPayloads []dirPayload
+
+// loadPayloadDir reads every regular file directly inside dir. Hidden files
+// and subdirectories are skipped.
+func loadPayloadDir(dir string) ([]dirPayload, error) {
+    entries, err := os.ReadDir(dir)
+    if err != nil {
+        return nil, err
+    }
+    sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+
+    var payloads []dirPayload
+    var total int64
+    for _, entry := range entries {
+        if !entry.Type().IsRegular() || entry.Name()[0] == '.' {
+            continue
+        }
+        info, err := entry.Info()
+        if err != nil {
+            return nil, err
+        }
+        if total += info.Size(); total > maxPayloadDirBytes {
+            return nil, fmt.Errorf("%s holds more than %d MiB of payloads", dir, maxPayloadDirBytes>>20)
+        }
+        data, err := os.ReadFile(filepath.Join(dir, entry.Name()))
+        if err != nil {
+            return nil, err
+        }
+        payloads = append(payloads, dirPayload{data: data})
+    }
+    if len(payloads) == 0 {
+        return nil, fmt.Errorf("no files in %s", dir)
+    }
+    return payloads, nil
+}
+
+// pickPayload returns a -payload-dir file chosen at random with rng.
+func pickPayload(rng *rand.Rand) []byte {
+    p := &dirPayloads[rng.Intn(len(dirPayloads))]
+    if atomic.LoadInt32(&p.sent) == 0 {
+        atomic.StoreInt32(&p.sent, 1)
+    }
+    return p.data
+}
+
+// payloadsSent returns how many distinct -payload-dir files have been sent.
+func payloadsSent() int {
+    n := 0
+    for i := range dirPayloads {
+        n += int(atomic.LoadInt32(&dirPayloads[i].sent))
+    }
+    return n
+}
@@ -0,0 +1,403 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// pipelineBaselineLength is how long a -pipeline run first measures the
+// throughput of the same connections without pipelining, to compare against.
+const pipelineBaselineLength = 5 * time.Second
+
+// errPipelineClosed fails the requests of a batch that were still
+// unanswered when the server closed the connection.
+var errPipelineClosed = errors.New("connection closed with pipelined requests unanswered")
+
+// PipelineStats describes a -pipeline run: the depth asked for, the mean
+// number of requests actually sent per batch on each worker's connection,
+// which is lower when batches are cut short by the end of the run or a
+// closed connection, and the throughput of the baseline without pipelining.
+type PipelineStats struct {
+    Depth              int       `json:"depth"`
+    ConnectionDepths   []float64 `json:"connection_depths"`
+    BaselineThroughput float64   `json:"baseline_throughput"`
+    Speedup            float64   `json:"speedup,omitempty"`
+}
+
+// pipeWorkerStats counts what one -pipeline worker sent, whether or not it
+// was measured.
+type pipeWorkerStats struct {
+    batches   int
+    requests  int
+    completed int // requests answered without error
+}
+
+// pipeConn is a raw HTTP/1.1 connection that requests are pipelined over,
+// since net/http waits for each response before sending the next request.
+type pipeConn struct {
+    conn net.Conn
+    br   *bufio.Reader
+    bw   *bufio.Writer
+}
+
+// pipeResponse is the outcome of one request of a pipelined batch.
+type pipeResponse struct {
+    status int
+    header http.Header
+    body   []byte // kept only for -expect-body-regex
+    digest *bodyDigest
+    bytes  int64
+    done   time.Time
+    err    error
+}
+
+// dialPipe connects to the host of req, with TLS for https using tlsConfig.
+func dialPipe(ctx context.Context, req *http.Request, tlsConfig *tls.Config) (*pipeConn, error) {
+    port := req.URL.Port()
+    if port == "" {
+        port = "80"
+        if req.URL.Scheme == "https" {
+            port = "443"
+        }
+    }
+    conn, err := dialContext(ctx, "tcp", net.JoinHostPort(req.URL.Hostname(), port))
+    if err != nil {
+        return nil, err
+    }
+    if req.URL.Scheme == "https" {
+        config := tlsConfig.Clone()
+        if config.ServerName == "" {
+            config.ServerName = req.URL.Hostname()
+        }
+        config.NextProtos = []string{"http/1.1"}
+        tlsConn := tls.Client(conn, config)
+        if err := tlsConn.HandshakeContext(ctx); err != nil {
+            conn.Close()
+            return nil, err
+        }
+        conn = tlsConn
+    }
+    return &pipeConn{conn: conn, br: bufio.NewReader(conn), bw: bufio.NewWriter(conn)}, nil
+}
+
+// send writes reqs back to back and then reads their responses in order,
+// all within -timeout. Cancelling ctx aborts the batch. Once one request
+// fails the connection is unusable, so it and the rest of the batch get the
+// same error. send reports whether the connection can be used again.
+func (pc *pipeConn) send(ctx context.Context, reqs []*http.Request) ([]pipeResponse, bool) {
+    pc.conn.SetDeadline(time.Now().Add(*timeout))
+    stop := make(chan struct{})
+    stopped := make(chan struct{})
+    go func() {
+        defer close(stopped)
+        select {
+        case <-ctx.Done():
+            pc.conn.SetDeadline(time.Now())
+        case <-stop:
+        }
+    }()
+    defer func() {
+        close(stop)
+        <-stopped
+    }()
+
+    responses := make([]pipeResponse, len(reqs))
+    fail := func(from int, err error) ([]pipeResponse, bool) {
+        for i := from; i < len(responses); i++ {
+            responses[i] = pipeResponse{done: time.Now(), err: err}
+        }
+        return responses, false
+    }
+
+    for _, req := range reqs {
+        if err := req.Write(pc.bw); err != nil {
+            return fail(0, err)
+        }
+    }
+    if err := pc.bw.Flush(); err != nil {
+        return fail(0, err)
+    }
+
+    for i, req := range reqs {
+        resp, err := http.ReadResponse(pc.br, req)
+        if err != nil {
+            return fail(i, err)
+        }
+        wire := &byteCounter{r: resp.Body}
+        decoder, _, err := decodeBody(resp.Header.Get("Content-Encoding"), wire)
+        var body []byte
+        var digest *bodyDigest
+        sink := io.Discard
+        if *hashBodies {
+            digest = newBodyDigest()
+            sink = digest
+        }
+        if err == nil {
+            if expectBody != nil {
+                body, err = io.ReadAll(decoder)
+                sink.Write(body)
+            } else {
+                _, err = io.Copy(sink, decoder)
+            }
+        }
+        if err == nil {
+            _, err = io.Copy(io.Discard, wire)
+        }
+        resp.Body.Close()
+        responses[i] = pipeResponse{status: resp.StatusCode, header: resp.Header, body: body, digest: digest, bytes: wire.n, done: time.Now(), err: err}
+        if err != nil {
+            return fail(i+1, err)
+        }
+        if resp.Close && i < len(reqs)-1 {
+            return fail(i+1, errPipelineClosed)
+        }
+        if resp.Close {
+            return responses, false
+        }
+    }
+    return responses, true
+}
+
+// runPipelined is run for a pool with a pipeline depth. Each worker keeps
+// one raw connection, reopened when it fails, and sends batches of up to
+// depth requests on it before reading their responses. Every request of a
+// batch is timed from when the batch was sent.
+func (p *workerPool) runPipelined(ctx context.Context) []sample {
+    var wg sync.WaitGroup
+    var mu sync.Mutex
+    var allSamples []sample
+
+    tlsConfig, err := buildTLSConfig()
+    if err != nil {
+        fmt.Fprintln(logOut, "Error configuring TLS:", err)
+        return nil
+    }
+
+    requestCtx, abortRequests := p.requestContext(ctx)
+    defer abortRequests()
+
+    for i := 0; i < p.workers; i++ {
+        wg.Add(1)
+        go func(i int) {
+            defer wg.Done()
+            var samples []sample
+            var stats pipeWorkerStats
+            var pc *pipeConn
+            defer func() {
+                if pc != nil {
+                    pc.conn.Close()
+                }
+                mu.Lock()
+                allSamples = mergeSamples(allSamples, samples)
+                p.pipeStats = append(p.pipeStats, stats)
+                mu.Unlock()
+            }()
+            rng := newRand(int64(i) + 1)
+
+            if p.rampUp > 0 {
+                select {
+                case <-time.After(p.rampUp * time.Duration(i) / time.Duration(p.workers)):
+                case <-ctx.Done():
+                    return
+                }
+            }
+
+            // A batch is measured once the worker has sent its warmup
+            // requests, so the warmup is rounded up to whole batches
+            sent := 0
+            for n := 0; ctx.Err() == nil; n++ {
+                if n > 0 && !think(ctx, rng) {
+                    break
+                }
+                measuring := sent >= p.warmupReqs && !time.Now().Before(p.measureStart)
+                var reqs []*http.Request
+                var dues []time.Time
+                for len(reqs) < p.pipeline {
+                    due, ok := p.admit(ctx, measuring)
+                    if !ok {
+                        break
+                    }
+                    req, err := createRequest(requestCtx, nextURL(rng), rng)
+                    if err != nil {
+                        if measuring {
+                            countFailure()
+                            countError("request build error")
+                        }
+                        continue
+                    }
+                    reqs = append(reqs, req)
+                    dues = append(dues, due)
+                }
+                if len(reqs) == 0 {
+                    break
+                }
+                sent += len(reqs)
+
+                fresh := pc == nil
+                var responses []pipeResponse
+                var dialErr error
+                startTime := time.Now()
+                if fresh {
+                    pc, dialErr = dialPipe(requestCtx, reqs[0], tlsConfig)
+                }
+                if dialErr != nil {
+                    responses = make([]pipeResponse, len(reqs))
+                    for j := range responses {
+                        responses[j] = pipeResponse{done: time.Now(), err: dialErr}
+                    }
+                    if measuring {
+                        atomic.AddInt64(&connectFailures, 1)
+                    }
+                } else {
+                    if fresh && measuring {
+                        atomic.AddInt64(&newConnections, 1)
+                        countRemote(pc.conn.RemoteAddr().String())
+                        if tc, ok := pc.conn.(*tls.Conn); ok {
+                            countHandshake(tc.ConnectionState().DidResume)
+                        }
+                    }
+                    var alive bool
+                    atomic.AddInt64(&inFlight, int64(len(reqs)))
+                    responses, alive = pc.send(requestCtx, reqs)
+                    atomic.AddInt64(&inFlight, -int64(len(reqs)))
+                    if !alive {
+                        pc.conn.Close()
+                        pc = nil
+                    }
+                }
+                // A batch aborted by the drain timeout says nothing about
+                // the server, so it is dropped rather than failed
+                if requestCtx.Err() != nil {
+                    break
+                }
+
+                stats.batches++
+                stats.requests += len(reqs)
+                for _, r := range responses {
+                    if r.err == nil {
+                        stats.completed++
+                    }
+                }
+                if !measuring {
+                    continue
+                }
+                for j, r := range responses {
+                    req := reqs[j]
+                    delay := sendDelay(dues[j], startTime)
+                    responseTime := r.done.Sub(startTime) + delay
+                    reused := dialErr == nil && (!fresh || j > 0)
+                    if reused {
+                        atomic.AddInt64(&reusedConnections, 1)
+                    }
+                    if req.ContentLength > 0 {
+                        atomic.AddInt64(&bytesSent, req.ContentLength)
+                    }
+                    atomic.AddInt64(&bytesReceived, r.bytes)
+                    s := sample{
+                        Start:    startTime,
+                        Duration: responseTime,
+                        Delay:    delay,
+                        Status:   r.status,
+                        Bytes:    r.bytes,
+                        Host:     req.URL.Host,
+                        Reused:   reused,
+                        Err:      r.err,
+                    }
+                    if r.err != nil {
+                        samples = keepSample(samples, s)
+                        recordFailure(r.err)
+                        logRequest(req.Method, req.URL.String(), r.status, responseTime, r.err, true)
+                        continue
+                    }
+                    recordProgress(responseTime)
+                    if class := r.status / 100; class > 0 && class < len(statusClasses) {
+                        atomic.AddInt64(&statusClasses[class], 1)
+                    }
+                    if len(captureHeaders) > 0 {
+                        captureHeaderValues(r.header)
+                    }
+                    if r.digest != nil {
+                        recordBodyHash(r.digest)
+                    }
+                    if r.status/100 == 3 && r.header.Get("Location") != "" {
+                        atomic.AddInt64(&redirects, 1)
+                    }
+                    atomic.AddInt64(&protocols[protocolIndex(1, 1)], 1)
+                    s.Failed = !countOutcome(req, r.status, validResponse(r.status, r.body), *expectStatus != 0, responseTime)
+                    samples = keepSample(samples, s)
+                }
+            }
+        }(i)
+    }
+
+    wg.Wait()
+    return allSamples
+}
+
+// pipelineBaseline measures the throughput of the pool's workers sending one
+// request at a time over the same kind of raw connection, for
+// pipelineBaselineLength or until ctx is done. Nothing it sends is recorded.
+func pipelineBaseline(ctx context.Context, workers int) float64 {
+    ctx, cancel := context.WithTimeout(ctx, pipelineBaselineLength)
+    defer cancel()
+    pool := &workerPool{
+        workers:      workers,
+        measureStart: time.Now().Add(24 * time.Hour), // nothing is measured
+        drainTimeout: *drainTimeout,
+        pipeline:     1,
+    }
+    start := time.Now()
+    pool.runPipelined(ctx)
+    elapsed := time.Since(start)
+
+    completed := 0
+    for _, stats := range pool.pipeStats {
+        completed += stats.completed
+    }
+    return float64(completed) / elapsed.Seconds()
+}
+
+// pipelineStats summarizes the workers of a -pipeline run.
+func pipelineStats(depth int, workers []pipeWorkerStats, throughput, baseline float64) *PipelineStats {
+    stats := &PipelineStats{Depth: depth, BaselineThroughput: baseline}
+    for _, w := range workers {
+        if w.batches > 0 {
+            stats.ConnectionDepths = append(stats.ConnectionDepths, float64(w.requests)/float64(w.batches))
+        }
+    }
+    if baseline > 0 {
+        stats.Speedup = throughput / baseline
+    }
+    return stats
+}
+
+// checkPipeline validates -pipeline against the other flags. Pipelined
+// requests bypass the HTTP client, so the flags that configure it don't
+// apply, and each worker keeps a single connection, so the targets must
+// share a host.
+func checkPipeline() error {
+    switch {
+    case *pipeline < 2:
+        return fmt.Errorf("Invalid -pipeline (expected 0 or at least 2): %v", *pipeline)
+    case *protocol != "http" || *mode != "steady":
+        return errors.New("-pipeline is only supported with -protocol http and -mode steady")
+    case *arrivalRate > 0 || *forceHTTP2 || *http2Only || *proxyURL != "" || *useCookies || *streamSize > 0 || !*keepAlive:
+        return errors.New("-pipeline sends over its own HTTP/1.1 connections and cannot be used with -arrival-rate, -http2, -http2-only, -proxy, -cookies, -stream-size or -keepalive=false")
+    }
+    hosts := targetHosts()
+    u, err := url.Parse(targetURLs[0])
+    if len(hosts) != 1 || err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+        return errors.New("-pipeline needs every target URL on the same http or https host")
+    }
+    return nil
+}
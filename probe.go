@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+// failFastAttempts is how many times -fail-fast tries the server before
+// giving up.
+const failFastAttempts = 4
+
+// Backoff between -fail-fast and -wait-for-server attempts starts at
+// firstProbeBackoff and doubles up to maxProbeBackoff.
+const (
+    firstProbeBackoff = 250 * time.Millisecond
+    maxProbeBackoff   = 5 * time.Second
+)
+
+// probe sends one request of the run, or one call with -protocol, and
+// describes the response. Any HTTP response counts, whatever its status,
+// since the point is whether the server is there at all. Nothing is
+// recorded.
+func probe(ctx context.Context) (string, error) {
+    ctx, cancel := context.WithTimeout(ctx, *timeout)
+    defer cancel()
+    start := time.Now()
+
+    if protocolOpener != nil {
+        call, closeCall, err := protocolOpener(ctx)
+        if err != nil {
+            return "", err
+        }
+        defer closeCall()
+        if _, _, err := call(ctx); err != nil {
+            return "", err
+        }
+        return fmt.Sprintf("call completed in %v", time.Since(start).Round(time.Microsecond)), nil
+    }
+
+    var req *http.Request
+    var err error
+    if len(scriptSteps) > 0 {
+        req, err = newScriptRun().request(ctx, sharedRand)
+    } else {
+        req, err = createRequest(ctx, targetURLs[0], sharedRand)
+    }
+    if err != nil {
+        return "", fmt.Errorf("creating request: %v", err)
+    }
+    resp, err := client.Do(req)
+    if err != nil {
+        return "", err
+    }
+    io.Copy(io.Discard, resp.Body)
+    resp.Body.Close()
+    return fmt.Sprintf("HTTP %d in %v", resp.StatusCode, time.Since(start).Round(time.Microsecond)), nil
+}
+
+// waitForServer implements -fail-fast and -wait-for-server: it probes the
+// server until it answers, backing off between attempts, for up to
+// failFastAttempts attempts or, with -wait-for-server, until that long has
+// passed. It returns the last error when the server never answered.
+func waitForServer(ctx context.Context) error {
+    var deadline time.Time
+    if *waitForSrv > 0 {
+        deadline = time.Now().Add(*waitForSrv)
+        fmt.Fprintf(logOut, "Waiting up to %v for the server to respond...\n", *waitForSrv)
+    } else {
+        fmt.Fprintln(logOut, "Checking that the server responds...")
+    }
+
+    backoff := firstProbeBackoff
+    for attempt := 1; ; attempt++ {
+        desc, err := probe(ctx)
+        if err == nil {
+            fmt.Fprintf(logOut, "Server responded (%s)\n", desc)
+            return nil
+        }
+        if ctx.Err() != nil {
+            return ctx.Err()
+        }
+
+        wait := backoff
+        if deadline.IsZero() {
+            if attempt == failFastAttempts {
+                return fmt.Errorf("no response after %d attempts: %v", attempt, err)
+            }
+        } else if left := time.Until(deadline); left <= 0 {
+            return fmt.Errorf("no response within %v (%d attempts): %v", *waitForSrv, attempt, err)
+        } else if left < wait {
+            wait = left
+        }
+        fmt.Fprintf(logOut, "Attempt %d failed: %v; retrying in %v\n", attempt, err, wait.Round(time.Millisecond))
+
+        select {
+        case <-time.After(wait):
+        case <-ctx.Done():
+            return ctx.Err()
+        }
+        if backoff *= 2; backoff > maxProbeBackoff {
+            backoff = maxProbeBackoff
+        }
+    }
+}
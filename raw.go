@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bufio"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// rawVersion is written in every -raw-out header and bumped whenever the
+// encoding changes incompatibly.
+const rawVersion = 2
+
+// rawChunkSize is the number of samples encoded per gob value, which keeps
+// the encoder's buffers small on long runs.
+const rawChunkSize = 4096
+
+// rawHeader starts a -raw-out file. The result carries the statistics that
+// can't be recomputed from the samples alone, such as the connection timing
+// breakdown and resource usage.
+type rawHeader struct {
+    Version int
+    Window  time.Duration
+    Start   time.Time // samples' start times are stored relative to this
+    Result  Result
+}
+
+// rawSample is the encoded form of a sample. The start time is an offset,
+// which gob encodes far more compactly than a time.Time, and the error is
+// kept as text.
+type rawSample struct {
+    Offset   time.Duration
+    Duration time.Duration
+    Delay    time.Duration
+    Status   int
+    TTFB     time.Duration
+    Bytes    int64
+    Host     string
+    Reused   bool
+    Failed   bool
+    Err      string
+}
+
+// saveRaw writes the run to -raw-out, if set, as a gob stream of a
+// rawHeader followed by chunks of samples.
+func saveRaw(result Result, allSamples []sample, window time.Duration) {
+    if *rawOut == "" {
+        return
+    }
+    filename := artifactPath(*rawOut)
+    if err := writeRaw(filename, result, allSamples, window); err != nil {
+        fmt.Fprintln(logOut, "Error writing raw samples:", err)
+        return
+    }
+    fmt.Fprintf(logOut, "Saved %d raw samples to %s\n", len(allSamples), filename)
+}
+
+func writeRaw(filename string, result Result, allSamples []sample, window time.Duration) error {
+    f, err := os.Create(filename)
+    if err != nil {
+        return err
+    }
+    defer f.Close()
+
+    w := bufio.NewWriter(f)
+    enc := gob.NewEncoder(w)
+    header := rawHeader{Version: rawVersion, Window: window, Result: result}
+    if len(allSamples) > 0 {
+        header.Start = allSamples[0].Start
+    }
+    if err := enc.Encode(header); err != nil {
+        return err
+    }
+    chunk := make([]rawSample, 0, rawChunkSize)
+    for i, s := range allSamples {
+        rs := rawSample{Offset: s.Start.Sub(header.Start), Duration: s.Duration, Delay: s.Delay, Status: s.Status, TTFB: s.TTFB, Bytes: s.Bytes, Host: s.Host, Reused: s.Reused, Failed: s.Failed}
+        if s.Err != nil {
+            rs.Err = s.Err.Error()
+        }
+        chunk = append(chunk, rs)
+        if len(chunk) == rawChunkSize || i == len(allSamples)-1 {
+            if err := enc.Encode(chunk); err != nil {
+                return err
+            }
+            chunk = chunk[:0]
+        }
+    }
+    if err := w.Flush(); err != nil {
+        return err
+    }
+    return f.Close()
+}
+
+// readRaw loads a file written by writeRaw.
+func readRaw(filename string) (rawHeader, []sample, error) {
+    var header rawHeader
+    f, err := os.Open(filename)
+    if err != nil {
+        return header, nil, err
+    }
+    defer f.Close()
+
+    dec := gob.NewDecoder(bufio.NewReader(f))
+    if err := dec.Decode(&header); err != nil {
+        return header, nil, err
+    }
+    if header.Version != rawVersion {
+        return header, nil, fmt.Errorf("unsupported raw format version %d", header.Version)
+    }
+
+    var samples []sample
+    for {
+        var chunk []rawSample
+        if err := dec.Decode(&chunk); err == io.EOF {
+            break
+        } else if err != nil {
+            return header, nil, err
+        }
+        for _, rs := range chunk {
+            s := sample{Start: header.Start.Add(rs.Offset), Duration: rs.Duration, Delay: rs.Delay, Status: rs.Status, TTFB: rs.TTFB, Bytes: rs.Bytes, Host: rs.Host, Reused: rs.Reused, Failed: rs.Failed}
+            if rs.Err != "" {
+                s.Err = errors.New(rs.Err)
+            }
+            samples = append(samples, s)
+        }
+    }
+    return header, samples, nil
+}
+
+// analyzeRaw reports a run saved with -raw-out as if it had just finished,
+// recomputing the sample statistics so that the output, plotting and SLA
+// flags given now apply.
+func analyzeRaw(filename string) {
+    header, samples, err := readRaw(filename)
+    if err != nil {
+        fmt.Println("Error reading raw samples:", err)
+        exitCode = 2
+        return
+    }
+    fmt.Fprintf(logOut, "Analyzing %d samples from %s\n", len(samples), filename)
+
+    responseTimes := completedResponseTimes(samples)
+    if len(responseTimes) == 0 {
+        fmt.Fprintln(logOut, "No successful requests in the saved run, cannot compute statistics")
+        exitCode = 1
+        return
+    }
+    resetHdr()
+    for _, d := range responseTimes {
+        recordHdr(d)
+    }
+    saveHdr(header.Start, header.Start.Add(header.Window))
+
+    result := header.Result
+    summarizeSamples(&result, samples, responseTimes, header.Window)
+    // the -script steps and -client-count clients aren't set up now, so
+    // keep the saved breakdowns
+    result.Steps = header.Result.Steps
+    result.Clients = header.Result.Clients
+    reportResults(result, samples, responseTimes)
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"time"
+)
+
+// RepeatResult is the outcome of a -repeat run: every run's statistics and
+// how much p99 and throughput varied between them.
+type RepeatResult struct {
+    Runs       []Result `json:"runs"`
+    P99        Spread   `json:"p99"` // in nanoseconds, like other durations
+    Throughput Spread   `json:"throughput"`
+}
+
+// Spread summarizes one metric across repeated runs. Best and Worst are the
+// values of the best and worst run for that metric, which are numbered
+// from 1.
+type Spread struct {
+    Mean     float64 `json:"mean"`
+    StdDev   float64 `json:"stddev"`
+    CV       float64 `json:"cv_percent"` // StdDev as a percentage of Mean
+    Best     float64 `json:"best"`
+    BestRun  int     `json:"best_run"`
+    Worst    float64 `json:"worst"`
+    WorstRun int     `json:"worst_run"`
+}
+
+// newSpread summarizes values, where lower is better if lowerBetter is set.
+func newSpread(values []float64, lowerBetter bool) Spread {
+    var s Spread
+    for i, v := range values {
+        s.Mean += v / float64(len(values))
+        better := v > s.Best
+        worse := v < s.Worst
+        if lowerBetter {
+            better, worse = v < s.Best, v > s.Worst
+        }
+        if i == 0 || better {
+            s.Best, s.BestRun = v, i+1
+        }
+        if i == 0 || worse {
+            s.Worst, s.WorstRun = v, i+1
+        }
+    }
+    for _, v := range values {
+        s.StdDev += (v - s.Mean) * (v - s.Mean) / float64(len(values))
+    }
+    s.StdDev = math.Sqrt(s.StdDev)
+    if s.Mean != 0 {
+        s.CV = s.StdDev / s.Mean * 100
+    }
+    return s
+}
+
+// runRepeated runs the prepared benchmark -repeat times, pausing for
+// -cooldown in between, and reports the spread of the results instead of
+// each run's full statistics. A run that fails is left out of the spread and
+// an interrupt stops after the run in progress.
+func runRepeated(ctx context.Context, runner *Runner) {
+    var summary RepeatResult
+    for i := 1; i <= *repeat; i++ {
+        if i > 1 {
+            select {
+            case <-time.After(*cooldown):
+            case <-ctx.Done():
+            }
+            if ctx.Err() != nil {
+                break
+            }
+            if err := runner.prepare(); err != nil {
+                fmt.Fprintln(logOut, "Error preparing run:", err)
+                exitCode = 1
+                break
+            }
+        }
+
+        repeatRun = i
+        fmt.Fprintf(logOut, "\nRun %d of %d\n", i, *repeat)
+        result, err := runner.run(ctx)
+        if err != nil {
+            fmt.Fprintf(logOut, "Run %d failed: %v\n", i, err)
+            exitCode = 1
+            continue
+        }
+        fmt.Fprintf(logOut, "Run %d: p99 %v, %.2f requests/second, %d failed\n",
+            i, result.P99, result.Throughput, result.FailedRequests)
+        summary.Runs = append(summary.Runs, result)
+    }
+    repeatRun = 0
+
+    if len(summary.Runs) == 0 {
+        fmt.Fprintln(logOut, "\nNo run completed, cannot compare runs")
+        exitCode = 1
+        return
+    }
+    p99s := make([]float64, len(summary.Runs))
+    throughputs := make([]float64, len(summary.Runs))
+    for i, r := range summary.Runs {
+        p99s[i] = float64(r.P99)
+        throughputs[i] = r.Throughput
+    }
+    summary.P99 = newSpread(p99s, true)
+    summary.Throughput = newSpread(throughputs, false)
+
+    if *output == "json" {
+        enc := json.NewEncoder(os.Stdout)
+        enc.SetIndent("", "  ")
+        if err := enc.Encode(summary); err != nil {
+            fmt.Fprintln(os.Stderr, "Error encoding results:", err)
+        }
+        return
+    }
+    p99 := summary.P99
+    fmt.Printf("\nRepeat Summary (%d runs):\n", len(summary.Runs))
+    fmt.Printf("p99: mean %v, CV %.1f%%, best %v (run %d), worst %v (run %d)\n",
+        time.Duration(p99.Mean), p99.CV, time.Duration(p99.Best), p99.BestRun, time.Duration(p99.Worst), p99.WorstRun)
+    rps := summary.Throughput
+    fmt.Printf("Throughput: mean %.2f requests/second, CV %.1f%%, best %.2f (run %d), worst %.2f (run %d)\n",
+        rps.Mean, rps.CV, rps.Best, rps.BestRun, rps.Worst, rps.WorstRun)
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+    "bytes"
+    "encoding/base64"
+    "fmt"
+    "html/template"
+    "os"
+    "strings"
+    "time"
+
+    "gonum.org/v1/plot"
+    "gonum.org/v1/plot/vg"
+)
+
+// reportTemplate renders the -html report. Charts are embedded as data URIs
+// so the file can be shared on its own.
+var reportTemplate = template.Must(template.New("report").Funcs(template.FuncMap{
+    "inc":             func(i int) int { return i + 1 },
+    "dropAdvice":      func() string { return connectionDropAdvice },
+    "percentileLabel": percentileLabel,
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Benchmark report: {{.Target}}</title>
+<style>
+body { font-family: sans-serif; margin: 2em; color: #222; }
+table { border-collapse: collapse; margin-bottom: 1.5em; }
+th, td { border: 1px solid #ccc; padding: 4px 10px; text-align: left; }
+th { background: #f2f2f2; }
+code { background: #f2f2f2; padding: 2px 4px; }
+img { max-width: 100%; }
+</style>
+</head>
+<body>
+<h1>Benchmark report</h1>
+<p>Generated {{.Generated}}{{if .Result.Interrupted}} &mdash; <strong>run was interrupted; statistics cover the partial run</strong>{{end}}</p>
+
+<h2>Parameters</h2>
+<table>
+<tr><th>Target</th><td>{{.Target}}</td></tr>
+<tr><th>Method</th><td>{{.Method}}</td></tr>
+<tr><th>Concurrency</th><td>{{.Concurrency}}</td></tr>
+<tr><th>{{if .Requests}}Requests{{else}}Duration{{end}}</th><td>{{if .Requests}}{{.Requests}}{{else if .Duration}}{{.Duration}}{{else}}until interrupted{{end}}</td></tr>
+<tr><th>Mode</th><td>{{.Mode}}</td></tr>
+<tr><th>Command</th><td><code>{{.Command}}</code></td></tr>
+</table>
+
+<h2>Response Time Statistics</h2>
+<table>
+<tr><th>Mean</th><td>{{.Result.Mean}}</td></tr>
+<tr><th>Median</th><td>{{.Result.Median}}</td></tr>
+<tr><th>75th Percentile</th><td>{{.Result.P75}}</td></tr>
+<tr><th>90th Percentile</th><td>{{.Result.P90}}</td></tr>
+<tr><th>95th Percentile</th><td>{{.Result.P95}}</td></tr>
+<tr><th>99th Percentile</th><td>{{.Result.P99}}</td></tr>
+<tr><th>99.9th Percentile</th><td>{{.Result.P999}}</td></tr>
+{{if .Result.TargetRate}}<tr><th>99th Percentile (uncorrected)</th><td>{{.Result.UncorrectedP99}}</td></tr>
+{{end}}<tr><th>Min</th><td>{{.Result.Min}}</td></tr>
+<tr><th>Max</th><td>{{.Result.Max}}</td></tr>
+<tr><th>Standard Deviation</th><td>{{.Result.StdDev}}</td></tr>
+<tr><th>Throughput</th><td>{{printf "%.2f" .Result.Throughput}} requests/second</td></tr>
+{{with .Result.Concurrency}}<tr><th>Concurrency</th><td>{{.Configured}} configured, {{printf "%.1f" .Mean}} in flight on average, at most {{.Max}}</td></tr>
+{{end}}</table>
+{{with .Result.Confidence}}<h2>Confidence Intervals ({{.Level}}%, {{.Resamples}} resamples)</h2>
+<table>
+{{range .Percentiles}}<tr><th>{{percentileLabel .Percentile}}</th><td>{{.Low}} to {{.High}}</td></tr>
+{{end}}</table>
+{{end}}
+{{with .Result.FirstByte}}<h2>Time to First Byte vs. Total</h2>
+<table>
+<tr><th></th><th>First Byte</th><th>Total</th></tr>
+<tr><th>Median</th><td>{{.Median}}</td><td>{{$.Result.Median}}</td></tr>
+<tr><th>90th Percentile</th><td>{{.P90}}</td><td>{{$.Result.P90}}</td></tr>
+<tr><th>95th Percentile</th><td>{{.P95}}</td><td>{{$.Result.P95}}</td></tr>
+<tr><th>99th Percentile</th><td>{{.P99}}</td><td>{{$.Result.P99}}</td></tr>
+<tr><th>Max</th><td>{{.Max}}</td><td>{{$.Result.Max}}</td></tr>
+</table>
+{{end}}
+{{with .Result.ResponseSizes}}<h2>Response Sizes</h2>
+<table>
+<tr><th>Min</th><td>{{.Min}} bytes</td></tr>
+<tr><th>Mean</th><td>{{.Mean}} bytes</td></tr>
+<tr><th>Median</th><td>{{.Median}} bytes</td></tr>
+<tr><th>99th Percentile</th><td>{{.P99}} bytes</td></tr>
+<tr><th>Max</th><td>{{.Max}} bytes</td></tr>
+</table>
+{{end}}
+<h2>Requests</h2>
+<table>
+<tr><th>Successful</th><td>{{.Result.SuccessfulRequests}}</td></tr>
+<tr><th>Failed</th><td>{{.Result.FailedRequests}}</td></tr>
+<tr><th>Timeouts</th><td>{{.Result.Timeouts}}</td></tr>
+{{range $class, $count := .Result.StatusCodes}}{{$ls := index $.Result.StatusLatency $class}}<tr><th>{{$class}}</th><td>{{$count}}{{if $ls.Count}} (mean {{$ls.Mean}}, p99 {{$ls.P99}}){{end}}</td></tr>
+{{end}}{{if .Result.Redirects}}<tr><th>Redirects</th><td>{{.Result.Redirects}} ({{printf "%.1f" .Result.RedirectRate}}% of responses)</td></tr>
+{{end}}</table>
+
+{{range $name, $counts := .Result.Headers}}<h2>Captured Header {{$name}}</h2>
+<table>
+{{range $value, $n := $counts}}<tr><th>{{$value}}</th><td>{{$n}}</td></tr>
+{{end}}</table>
+{{end}}
+{{with .Result.BodyHashes}}<h2>Response Bodies</h2>
+<p>{{.Distinct}} distinct bodies in {{.Responses}} responses{{if gt .Distinct (len .Samples)}}, the first {{len .Samples}} kept{{end}}.</p>
+<table>
+<tr><th>Hash</th><th>Responses</th><th>Body</th></tr>
+{{range .Samples}}<tr><td>{{.Hash}}</td><td>{{.Count}}</td><td><pre>{{.Body}}{{if .Truncated}}...{{end}}</pre></td></tr>
+{{end}}</table>
+{{end}}
+{{if .Result.Hosts}}<h2>Hosts</h2>
+<table>
+<tr><th>Host</th><th>Requests</th><th>Failed</th><th>Mean</th><th>Median</th><th>p99</th><th>Reused / New Connections</th></tr>
+{{range $host, $hs := .Result.Hosts}}<tr><td>{{$host}}</td><td>{{$hs.Requests}}</td><td>{{$hs.Failed}}</td><td>{{$hs.Mean}}</td><td>{{$hs.Median}}</td><td>{{$hs.P99}}</td><td>{{$hs.ReusedConnections}} / {{$hs.NewConnections}}</td></tr>
+{{end}}</table>
+{{end}}
+{{if .Result.Steps}}<h2>Script Steps</h2>
+<p>{{.Result.Journeys}} journeys completed.</p>
+<table>
+<tr><th>Step</th><th>Requests</th><th>Failed</th><th>Mean</th><th>Median</th><th>p99</th></tr>
+{{range .Result.Steps}}<tr><td>{{.Name}}</td><td>{{.Requests}}</td><td>{{.Failed}}</td><td>{{.Mean}}</td><td>{{.Median}}</td><td>{{.P99}}</td></tr>
+{{end}}</table>
+{{end}}
+{{if .Result.Errors}}<h2>Error Types</h2>
+<table>
+{{range $kind, $count := .Result.Errors}}<tr><th>{{$kind}}</th><td>{{$count}}</td></tr>
+{{end}}</table>
+{{if .Result.ConnectionDrops}}<p>{{.Result.ConnectionDrops}} requests failed on a dropped connection. {{dropAdvice}}</p>
+{{end}}{{end}}
+{{if .Result.Phases}}<h2>Connection Timing Breakdown</h2>
+<table>
+<tr><th>Phase</th><th>Mean</th><th>p99</th><th>Requests</th></tr>
+{{range .Result.Phases}}<tr><td>{{.Phase}}</td><td>{{.Mean}}</td><td>{{.P99}}</td><td>{{.Count}}</td></tr>
+{{end}}</table>
+{{end}}
+{{if .Result.Bursts}}<h2>Burst Phases</h2>
+<table>
+<tr><th>Burst</th><th>Requests</th><th>Mean</th><th>Median</th><th>p99</th></tr>
+{{range $i, $b := .Result.Bursts}}<tr><td>{{inc $i}}</td><td>{{$b.Requests}}</td><td>{{$b.Mean}}</td><td>{{$b.Median}}</td><td>{{$b.P99}}</td></tr>
+{{end}}</table>
+{{end}}
+{{if .Result.Windows}}<h2>Latency by Window</h2>
+<table>
+<tr><th>From</th><th>Requests</th><th>Median</th><th>p99</th></tr>
+{{range .Result.Windows}}<tr><td>{{.Start}}</td><td>{{.Requests}}</td><td>{{.Median}}</td><td>{{.P99}}</td></tr>
+{{end}}</table>
+{{end}}
+{{if .Histogram}}<h2>Charts</h2>
+<p><img alt="Response time distribution" src="{{.Histogram}}"></p>{{end}}
+{{if .Timeline}}<p><img alt="Response time over time" src="{{.Timeline}}"></p>{{end}}
+{{if .Throughput}}<p><img alt="Throughput over time" src="{{.Throughput}}"></p>{{end}}
+</body>
+</html>
+`))
+
+// writeHTMLReport writes a single HTML file with the run parameters, the
+// summary statistics and the response time histogram, latency timeline and
+// throughput timeline.
+func writeHTMLReport(result Result, samples []sample, responseTimes []time.Duration, filename string) error {
+    target := *server
+    if *urlsFile != "" {
+        target = *urlsFile
+    } else if *script != "" {
+        target = *script
+    }
+    data := struct {
+        Target      string
+        Method      string
+        Concurrency int
+        Requests    int64
+        Duration    time.Duration
+        Mode        string
+        Command     string
+        Generated   string
+        Result      Result
+        Histogram   template.URL
+        Timeline    template.URL
+        Throughput  template.URL
+    }{
+        Target:      target,
+        Method:      *method,
+        Concurrency: *concurrency,
+        Requests:    *totalRequests,
+        Duration:    *duration,
+        Mode:        *mode,
+        Command:     strings.Join(os.Args, " "),
+        Generated:   time.Now().Format(time.RFC1123),
+        Result:      result,
+    }
+
+    // A chart that can't be drawn is left out rather than losing the report
+    if !*noPlot {
+        var err error
+        data.Histogram, data.Timeline, data.Throughput, err = reportCharts(result, samples, responseTimes)
+        if err != nil {
+            fmt.Fprintln(logOut, "Error plotting report charts:", err)
+        }
+    }
+
+    f, err := os.Create(filename)
+    if err != nil {
+        return err
+    }
+    if err := reportTemplate.Execute(f, data); err != nil {
+        f.Close()
+        return err
+    }
+    return f.Close()
+}
+
+// reportCharts renders the charts embedded in the HTML report. The timeline
+// and throughput charts are empty when there is nothing to draw.
+func reportCharts(result Result, samples []sample, responseTimes []time.Duration) (hist, timeline, throughput template.URL, err error) {
+    defer func() {
+        if r := recover(); r != nil {
+            hist, timeline, throughput, err = "", "", "", fmt.Errorf("%v", r)
+        }
+    }()
+
+    p, err := responseTimeHistogram(responseTimes, *bins, *logScale, *targetLatency)
+    if err != nil {
+        return "", "", "", err
+    }
+    if hist, err = plotDataURI(p); err != nil {
+        return "", "", "", err
+    }
+    line, err := latencyTimeline(samples)
+    if err != nil {
+        return "", "", "", err
+    }
+    if line != nil {
+        if timeline, err = plotDataURI(line); err != nil {
+            return "", "", "", err
+        }
+    }
+    rps, err := throughputPlot(result.ThroughputSeries)
+    if err != nil {
+        return "", "", "", err
+    }
+    if rps != nil {
+        if throughput, err = plotDataURI(rps); err != nil {
+            return "", "", "", err
+        }
+    }
+    return hist, timeline, throughput, nil
+}
+
+// plotDataURI renders p as a PNG and returns it as a data URI suitable for
+// an img src attribute.
+func plotDataURI(p *plot.Plot) (template.URL, error) {
+    w, err := p.WriterTo(8*vg.Inch, 4*vg.Inch, "png")
+    if err != nil {
+        return "", err
+    }
+    var buf bytes.Buffer
+    if _, err := w.WriteTo(&buf); err != nil {
+        return "", err
+    }
+    return template.URL("data:image/png;base64," + base64.StdEncoding.EncodeToString(buf.Bytes())), nil
+}
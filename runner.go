@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Runner runs a benchmark from Go code instead of the command line, for
+// example in a test that asserts on a service's latency:
+//
+//	server, requests := "http://localhost:8080/", int64(1000)
+//	r := &Runner{Config: Config{Server: &server, Requests: &requests}}
+//	result, err := r.Run(ctx)
+//
+// Config is keyed like the flags. Settings it leaves out keep the flag's
+// current value: its default, unless the command line or an earlier Runner
+// set it. The benchmark keeps its state in package variables, so only one
+// Runner can run at a time. This package is a command and can't be imported,
+// so a Runner is used from tests and code in this directory.
+type Runner struct {
+    Config Config
+
+    // Log receives the progress messages the command prints during a run,
+    // such as the worker banner and the names of saved files. They are
+    // discarded when it is nil.
+    Log io.Writer
+
+    applied       bool
+    samples       []sample
+    responseTimes []time.Duration
+}
+
+// Run validates the configuration, runs the benchmark until it finishes or
+// ctx is cancelled, and returns its statistics. Progress messages go to Log
+// and nothing is printed or plotted, except that -verbose still logs each
+// request to stderr, but files the configuration asks for, such as CSV, are
+// written. A run in which no request completed returns an error.
+func (r *Runner) Run(ctx context.Context) (Result, error) {
+    if err := r.prepare(); err != nil {
+        return Result{}, err
+    }
+    defer func(out io.Writer) { logOut = out }(logOut)
+    logOut = io.Discard
+    if r.Log != nil {
+        logOut = r.Log
+    }
+    return r.run(ctx)
+}
+
+// ResponseTimes returns the sorted response times of the requests that
+// completed during the last run, or nil when it didn't retain its samples.
+func (r *Runner) ResponseTimes() []time.Duration {
+    return r.responseTimes
+}
+
+// prepare sets up a run. Config is applied on the first run only, since
+// list settings such as Header would otherwise be added again each time, so
+// later changes to it have no effect.
+func (r *Runner) prepare() error {
+    if !r.applied {
+        if err := r.Config.apply(); err != nil {
+            return err
+        }
+        r.applied = true
+    }
+    resetState()
+    return setup()
+}
+
+// run runs the prepared benchmark alongside the resource monitor, which
+// stops once the benchmark does.
+func (r *Runner) run(ctx context.Context) (Result, error) {
+    ctx, cancel := context.WithCancel(ctx)
+    defer cancel()
+    stopRun = cancel
+
+    var wg sync.WaitGroup
+    wg.Add(1)
+    go trackResourceUsage(ctx, &wg)
+
+    var result Result
+    var err error
+    if *mode == "burst" {
+        result, r.samples, r.responseTimes, err = burstTest(ctx)
+    } else {
+        result, r.samples, r.responseTimes, err = benchmark(ctx)
+    }
+    cancel()
+    wg.Wait()
+    savePrometheus()
+    return result, err
+}
+
+// resetState clears the counters and everything else a run leaves behind, so
+// that runs in the same process don't add up.
+func resetState() {
+    for _, counter := range []*int64{
+        &successfulRequests, &failedRequests, &timeoutRequests, &validationFailures,
+        &connectFailures, &truncatedResponses, &encodedResponses, &encodedBytes,
+        &decodedBytes, &redirects, &reusedConnections, &newConnections,
+        &bytesSent, &bytesReceived, &journeysCompleted, &resumedSessions, &fullHandshakes,
+    } {
+        atomic.StoreInt64(counter, 0)
+    }
+    statusClasses = [len(statusClasses)]int64{}
+    tlsVersions = [len(tlsVersions)]int64{}
+    protocols = [len(protocols)]int64{}
+    atomic.StoreInt32(&interrupted, 0)
+    atomic.StoreInt32(&autoStopped, 0)
+    atomic.StoreInt32(&errorBudgetExceeded, 0)
+    atomic.StoreUint64(&urlCounter, 0)
+    atomic.StoreUint64(&requestSeq, 0)
+    stopRun = func() {}
+
+    remoteAddrs.mu.Lock()
+    remoteAddrs.counts = nil
+    remoteAddrs.mu.Unlock()
+    errorKinds.mu.Lock()
+    errorKinds.counts = nil
+    errorKinds.mu.Unlock()
+    capturedHeaders.mu.Lock()
+    capturedHeaders.counts = nil
+    capturedHeaders.mu.Unlock()
+    bodyHashes.mu.Lock()
+    bodyHashes.counts, bodyHashes.samples = nil, nil
+    bodyHashes.mu.Unlock()
+    progress.mu.Lock()
+    progress.times = nil
+    progress.mu.Unlock()
+    usage.mu.Lock()
+    usage.cpu, usage.memoryMB, usage.samples = 0, 0, nil
+    usage.mu.Unlock()
+    resetMetrics()
+    resetHdr()
+
+    if client != nil {
+        client.CloseIdleConnections()
+    }
+    for _, sim := range simClients {
+        sim.client.CloseIdleConnections()
+    }
+    simClients = nil
+    methodMix, methodTotal = nil, 0
+    uploads = nil
+    dirPayloads = nil
+    scriptSteps = nil
+    urlTemplates, payloadTemplate = nil, nil
+    expectBody = nil
+    signRequest = nil
+    envRedactor = nil
+    protocolOpener = nil
+    maxErrorRate = -1
+}
@@ -0,0 +1,374 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"text/template"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// scriptFile is the layout of a -script file: the steps of one journey, each
+// a request of its own.
+type scriptFile struct {
+    Steps []scriptStepSpec `json:"steps" yaml:"steps"`
+}
+
+// scriptStepSpec is a step as written in a -script file. The URL, headers
+// and payload are always templates, like -server and -payload with
+// -template, where {{.Vars.name}} is the value captured as name by an
+// earlier step of the journey.
+type scriptStepSpec struct {
+    Name            string            `json:"name" yaml:"name"`
+    Method          string            `json:"method" yaml:"method"`
+    URL             string            `json:"url" yaml:"url"`
+    Headers         map[string]string `json:"headers" yaml:"headers"`
+    Payload         string            `json:"payload" yaml:"payload"`
+    ExpectStatus    int               `json:"expect-status" yaml:"expect-status"`
+    ExpectBodyRegex string            `json:"expect-body-regex" yaml:"expect-body-regex"`
+    Capture         map[string]string `json:"capture" yaml:"capture"`               // variable -> regexp over the body
+    CaptureHeader   map[string]string `json:"capture-header" yaml:"capture-header"` // variable -> response header
+}
+
+// scriptStep is a compiled -script step.
+type scriptStep struct {
+    name         string
+    method       string
+    rawURL       string // with ${VAR} filled in
+    url          *template.Template
+    headers      map[string]*template.Template
+    payload      *template.Template // nil without a payload
+    expectStatus int
+    expectBody   *regexp.Regexp
+    captures     []scriptCapture
+}
+
+// scriptCapture takes a variable from a response: the first group of re
+// matched against the body, or the whole match when it has no group, or
+// else the value of header.
+type scriptCapture struct {
+    name   string
+    re     *regexp.Regexp
+    header string
+}
+
+// scriptSteps holds the -script steps, or nil without -script.
+var scriptSteps []scriptStep
+
+// journeysCompleted counts the measured journeys whose every step succeeded.
+var journeysCompleted int64
+
+// loadScript reads and compiles a -script file, as JSON if it has a .json
+// extension and as YAML otherwise. Each template is rendered once with the
+// variables captured before it, so a misspelt variable is reported at
+// startup rather than failing every journey.
+func loadScript(filename string) ([]scriptStep, error) {
+    data, err := os.ReadFile(filename)
+    if err != nil {
+        return nil, err
+    }
+    var file scriptFile
+    if strings.EqualFold(filepath.Ext(filename), ".json") {
+        dec := json.NewDecoder(bytes.NewReader(data))
+        dec.DisallowUnknownFields()
+        err = dec.Decode(&file)
+    } else {
+        dec := yaml.NewDecoder(bytes.NewReader(data))
+        dec.KnownFields(true)
+        err = dec.Decode(&file)
+    }
+    if err != nil {
+        return nil, fmt.Errorf("parsing %s: %v", filename, err)
+    }
+    if len(file.Steps) == 0 {
+        return nil, fmt.Errorf("%s has no steps", filename)
+    }
+
+    var steps []scriptStep
+    captured := make(map[string]string)
+    for i, spec := range file.Steps {
+        step, err := compileStep(spec, i, captured)
+        if err != nil {
+            return nil, fmt.Errorf("step %s: %v", step.name, err)
+        }
+        for _, prev := range steps {
+            if prev.name == step.name {
+                return nil, fmt.Errorf("step %s: the name is used more than once", step.name)
+            }
+        }
+        for _, c := range step.captures {
+            captured[c.name] = ""
+        }
+        steps = append(steps, step)
+    }
+    return steps, nil
+}
+
+// compileStep compiles step i of a script, given the variables captured by
+// the steps before it. The returned step always carries its name.
+func compileStep(spec scriptStepSpec, i int, captured map[string]string) (scriptStep, error) {
+    step := scriptStep{name: spec.Name, method: strings.ToUpper(spec.Method), expectStatus: spec.ExpectStatus}
+    if step.name == "" {
+        step.name = fmt.Sprintf("%d", i+1)
+    }
+    if step.method == "" {
+        step.method = http.MethodGet
+    }
+    if spec.URL == "" {
+        return step, errors.New("no url")
+    }
+
+    parse := func(name, text string) (*template.Template, error) {
+        t, err := template.New(name).Option("missingkey=error").Parse(text)
+        if err != nil {
+            return nil, err
+        }
+        if _, err := renderTemplate(t, requestVars{Vars: captured}); err != nil {
+            return nil, err
+        }
+        return t, nil
+    }
+    // ${VAR} is filled in from the environment, as in the flags
+    var err error
+    if step.rawURL, err = expandEnv(spec.URL); err != nil {
+        return step, err
+    }
+    if step.url, err = parse("url", step.rawURL); err != nil {
+        return step, err
+    }
+    if spec.Payload != "" {
+        payload, err := expandEnv(spec.Payload)
+        if err != nil {
+            return step, err
+        }
+        if step.payload, err = parse("payload", payload); err != nil {
+            return step, err
+        }
+    }
+    for key, value := range spec.Headers {
+        value, err := expandEnv(value)
+        if err != nil {
+            return step, err
+        }
+        t, err := parse(key, value)
+        if err != nil {
+            return step, err
+        }
+        if step.headers == nil {
+            step.headers = make(map[string]*template.Template)
+        }
+        step.headers[http.CanonicalHeaderKey(key)] = t
+    }
+
+    if spec.ExpectBodyRegex != "" {
+        if step.expectBody, err = regexp.Compile(spec.ExpectBodyRegex); err != nil {
+            return step, fmt.Errorf("invalid expect-body-regex: %v", err)
+        }
+    }
+    for name, pattern := range spec.Capture {
+        re, err := regexp.Compile(pattern)
+        if err != nil {
+            return step, fmt.Errorf("invalid capture %s: %v", name, err)
+        }
+        step.captures = append(step.captures, scriptCapture{name: name, re: re})
+    }
+    for name, header := range spec.CaptureHeader {
+        if _, dup := spec.Capture[name]; dup {
+            return step, fmt.Errorf("%s is captured twice", name)
+        }
+        step.captures = append(step.captures, scriptCapture{name: name, header: header})
+    }
+    sort.Slice(step.captures, func(a, b int) bool { return step.captures[a].name < step.captures[b].name })
+    return step, nil
+}
+
+// valid reports whether a response passes the step's own checks.
+func (s *scriptStep) valid(status int, body []byte) bool {
+    if s.expectStatus != 0 && status != s.expectStatus {
+        return false
+    }
+    return s.expectBody == nil || s.expectBody.Match(body)
+}
+
+// scriptURLs returns the URLs of the steps, with any ${VAR} filled in, to
+// stand in for -server as the run's targets.
+func scriptURLs() []string {
+    urls := make([]string, len(scriptSteps))
+    for i, step := range scriptSteps {
+        urls[i] = step.rawURL
+    }
+    return urls
+}
+
+// scriptRun is one worker's progress through the -script journey: the step
+// it sends next and the variables captured so far.
+type scriptRun struct {
+    next int
+    vars map[string]string
+}
+
+func newScriptRun() *scriptRun {
+    return &scriptRun{vars: make(map[string]string)}
+}
+
+// step returns the step the worker sends next.
+func (s *scriptRun) step() *scriptStep {
+    return &scriptSteps[s.next]
+}
+
+// request builds the request of the next step.
+func (s *scriptRun) request(ctx context.Context, rng *rand.Rand) (*http.Request, error) {
+    step := s.step()
+    vars := requestVars{Seq: atomic.AddUint64(&requestSeq, 1), Rand: rng.Int63(), Vars: s.vars}
+    url, err := renderTemplate(step.url, vars)
+    if err != nil {
+        return nil, err
+    }
+    var body []byte
+    if step.payload != nil {
+        if body, err = renderTemplate(step.payload, vars); err != nil {
+            return nil, err
+        }
+    }
+    var header http.Header
+    if len(step.headers) > 0 {
+        header = make(http.Header, len(step.headers))
+        for key, t := range step.headers {
+            value, err := renderTemplate(t, vars)
+            if err != nil {
+                return nil, err
+            }
+            header[key] = []string{string(value)}
+        }
+    }
+    return buildRequest(ctx, step.method, string(url), body, header)
+}
+
+// finish records the response to the current step, given whether it
+// arrived and passed the run's -expect-* checks, and moves on: to the next
+// step when it also passed the step's checks and every capture was found,
+// and otherwise back to the start of the journey with no variables, as the
+// later steps may depend on this one. It returns whether the response was
+// valid and whether that completed the journey.
+func (s *scriptRun) finish(ok bool, status int, header http.Header, body []byte) (valid, done bool) {
+    step := s.step()
+    valid = ok && step.valid(status, body)
+    for _, c := range step.captures {
+        if !valid {
+            break
+        }
+        var value string
+        if c.re != nil {
+            m := c.re.FindSubmatch(body)
+            if m == nil {
+                valid = false
+                break
+            }
+            value = string(m[len(m)-1])
+        } else {
+            if value = header.Get(c.header); value == "" {
+                valid = false
+                break
+            }
+        }
+        s.vars[c.name] = value
+    }
+
+    // A 4xx or 5xx the step didn't ask for fails it like any other request
+    if !valid || (status >= 400 && step.expectStatus == 0 && *expectStatus == 0) {
+        s.restart()
+        return valid, false
+    }
+    if s.next++; s.next == len(scriptSteps) {
+        s.restart()
+        return true, true
+    }
+    return true, false
+}
+
+// restart goes back to the first step of the journey.
+func (s *scriptRun) restart() {
+    s.next = 0
+    for name := range s.vars {
+        delete(s.vars, name)
+    }
+}
+
+// StepStats summarizes the requests of one -script step.
+type StepStats struct {
+    Name     string        `json:"name"`
+    Requests int64         `json:"requests"`
+    Failed   int64         `json:"failed"`
+    Mean     time.Duration `json:"mean"`
+    Median   time.Duration `json:"median"`
+    P99      time.Duration `json:"p99"`
+}
+
+// stepStats breaks the requests down by -script step, in script order. It
+// returns nil without a script.
+func stepStats(samples []sample) []StepStats {
+    if len(scriptSteps) == 0 {
+        return nil
+    }
+    byStep := make(map[string][]sample)
+    for _, s := range samples {
+        byStep[s.Step] = append(byStep[s.Step], s)
+    }
+
+    var stats []StepStats
+    for _, step := range scriptSteps {
+        ss := StepStats{Name: step.name}
+        var times []time.Duration
+        for _, s := range byStep[step.name] {
+            ss.Requests++
+            if s.Err != nil || s.Failed {
+                ss.Failed++
+            }
+            if s.Err == nil {
+                times = append(times, s.Duration)
+            }
+        }
+        if len(times) > 0 {
+            sort.Slice(times, func(i, j int) bool { return times[i] < times[j] })
+            var total time.Duration
+            for _, t := range times {
+                total += t
+            }
+            ss.Mean = total / time.Duration(len(times))
+            ss.Median = computePercentile(times, 50)
+            ss.P99 = computePercentile(times, 99)
+        }
+        stats = append(stats, ss)
+    }
+    return stats
+}
+
+// checkScript validates -script against the other flags. A journey is
+// carried by a worker from one step to the next, so the open model, where
+// each request is independent, doesn't apply, and the flags that choose a
+// request's URL, method or body are replaced by the steps.
+func checkScript() error {
+    switch {
+    case *protocol != "http":
+        return errors.New("-script is only supported with -protocol http")
+    case *arrivalRate > 0 || *pipeline > 0:
+        return errors.New("-script runs each journey on one worker and cannot be used with -arrival-rate or -pipeline")
+    case *server != "" || *urlsFile != "" || *payload != "" || *payloadFile != "" || *payloadDir != "" || *methodWeights != "":
+        return errors.New("-script sets the URL, method and payload of each request and cannot be used with -server, -urls-file, -payload, -payload-file, -payload-dir or -method-weights")
+    case len(formValues.values) > 0 || len(formFiles.values) > 0 || *streamSize > 0:
+        return errors.New("-script cannot be used with -form, -form-file or -stream-size")
+    }
+    return nil
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// runSeed seeds every random choice a run makes: the URL and method of each
+// request, think-time pauses, open-model arrivals and {{.Rand}} values.
+var runSeed int64
+
+// sharedRand draws random values for callers without a source of their own,
+// such as gRPC and WebSocket payload templates.
+var sharedRand *rand.Rand
+
+// initSeed sets runSeed from -seed, or picks one at random when it is 0, so
+// that any run can be replayed with the seed it logs.
+func initSeed() {
+    runSeed = *seed
+    if runSeed == 0 {
+        runSeed = time.Now().UnixNano()
+    }
+    sharedRand = rand.New(&lockedSource{src: rand.NewSource(runSeed)})
+}
+
+// newRand returns the source of random stream n of a run, such as one
+// worker. Streams are seeded from runSeed and n alone, so each makes the
+// same choices on a replay without contending for a shared lock.
+func newRand(n int64) *rand.Rand {
+    return rand.New(rand.NewSource(runSeed + n))
+}
+
+// lockedSource makes a rand.Source safe to share between goroutines.
+type lockedSource struct {
+    mu  sync.Mutex
+    src rand.Source
+}
+
+func (s *lockedSource) Int63() int64 {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    return s.src.Int63()
+}
+
+func (s *lockedSource) Seed(seed int64) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    s.src.Seed(seed)
+}
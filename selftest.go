@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"time"
+)
+
+// selfTestLatency is how long the -self-test server takes to respond.
+const selfTestLatency = 20 * time.Millisecond
+
+// selfTestTolerance is how far above selfTestLatency the measured median may
+// be before -self-test fails, as a fraction of it. Time spent in the client
+// and on loopback should be well under this.
+const selfTestTolerance = 0.25
+
+// selfTestRequests is the run length of -self-test when neither -requests
+// nor -duration is given.
+const selfTestRequests = 500
+
+// runSelfTest benchmarks an in-process server that responds after
+// selfTestLatency, through the same path as a real run, and checks that the
+// measured latency matches it. The other flags, such as -concurrency, apply
+// as usual, except that the server replaces any target. It returns the exit
+// code.
+func runSelfTest() int {
+    srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        timer := time.NewTimer(selfTestLatency)
+        defer timer.Stop()
+        select {
+        case <-timer.C:
+            w.Write([]byte("ok"))
+        case <-r.Context().Done():
+        }
+    }))
+    defer srv.Close()
+
+    explicit := make(map[string]bool)
+    flag.Visit(func(f *flag.Flag) { explicit[f.Name] = true })
+    *server, *urlsFile, *protocol = srv.URL, "", "http"
+    if !explicit["requests"] && !explicit["duration"] {
+        *totalRequests = selfTestRequests
+    }
+
+    fmt.Fprintf(logOut, "Self-test against a local server responding in %v\n", selfTestLatency)
+    runner := &Runner{Log: logOut}
+    result, err := runner.Run(context.Background())
+    if err != nil {
+        fmt.Println("Self-test failed:", err)
+        return 1
+    }
+
+    fmt.Printf("Requests: %d, failed %d\n", result.TotalRequests, result.FailedRequests)
+    fmt.Printf("Median: %v, p99: %v, min: %v\n", result.Median, result.P99, result.Min)
+    fmt.Printf("Throughput: %.2f requests/second\n", result.Throughput)
+
+    limit := selfTestLatency + time.Duration(float64(selfTestLatency)*selfTestTolerance)
+    var problems []string
+    if result.FailedRequests > 0 {
+        problems = append(problems, fmt.Sprintf("%d requests failed", result.FailedRequests))
+    }
+    // A response can't arrive before the server sends it, so a shorter time
+    // means the timing itself is wrong
+    if result.Min < selfTestLatency {
+        problems = append(problems, fmt.Sprintf("min %v is below the server latency of %v", result.Min, selfTestLatency))
+    }
+    if result.Median > limit {
+        problems = append(problems, fmt.Sprintf("median %v is above %v (server latency plus %.0f%%)", result.Median, limit, selfTestTolerance*100))
+    }
+    if len(problems) > 0 {
+        for _, p := range problems {
+            fmt.Println("Self-test failed:", p)
+        }
+        return 1
+    }
+    fmt.Println("Self-test passed")
+    return 0
+}
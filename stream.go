@@ -0,0 +1,386 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	hdrhistogram "github.com/HdrHistogram/hdrhistogram-go"
+	"gonum.org/v1/plot/plotter"
+)
+
+// retainSamples is whether the run keeps every request sample in memory. It
+// is set by setup, from -keep-samples and the outputs that need the samples
+// themselves. Otherwise each sample only updates the streaming statistics in
+// stream, whose size doesn't grow with the number of requests, so that a
+// soak test of many hours can't run out of memory.
+var retainSamples bool
+
+// streamBatch is how many samples a worker buffers before recording them in
+// stream, so that it takes the lock once per batch rather than per request.
+const streamBatch = 256
+
+// needSamples reports whether the flags ask for anything that is computed
+// from the individual samples rather than from their histograms.
+func needSamples() bool {
+    return *keepSamples || *csvFile != "" || *rawOut != "" || *timeline || *htmlFile != "" ||
+        *bootstrap > 0 || *latencyWindow > 0 || *mode == "burst"
+}
+
+// keepSample adds s to a worker's samples. When the run doesn't retain its
+// samples they are only buffered: once streamBatch of them have built up
+// they are recorded in stream and the buffer is emptied.
+func keepSample(samples []sample, s sample) []sample {
+    samples = append(samples, s)
+    if !retainSamples && len(samples) >= streamBatch {
+        stream.add(samples)
+        samples = samples[:0]
+    }
+    return samples
+}
+
+// mergeSamples adds the samples of a worker that stopped to all, or records
+// them in stream when the run doesn't retain its samples.
+func mergeSamples(all, samples []sample) []sample {
+    if !retainSamples {
+        stream.add(samples)
+        return all
+    }
+    return append(all, samples...)
+}
+
+// latencyGroup accumulates the requests of one host, step, status class or
+// connection phase: counts, the exact mean, standard deviation, minimum and
+// maximum of the completed ones, and a histogram for their percentiles.
+type latencyGroup struct {
+    requests int64
+    failed   int64 // transport errors and responses that counted as failures
+    reused   int64
+    fresh    int64
+    mean, m2 float64
+    min, max time.Duration
+    times    *hdrhistogram.Histogram
+}
+
+func newLatencyGroup() *latencyGroup {
+    return &latencyGroup{times: newLatencyHistogram()}
+}
+
+// add records one request.
+func (g *latencyGroup) add(s *sample) {
+    g.requests++
+    if s.Err != nil || s.Failed {
+        g.failed++
+    }
+    if s.Err != nil {
+        return
+    }
+    if s.Reused {
+        g.reused++
+    } else {
+        g.fresh++
+    }
+    g.addTime(s.Duration)
+}
+
+// addTime records the response time of a completed request, using
+// Welford's method for the mean and variance like summarizeSamples.
+func (g *latencyGroup) addTime(d time.Duration) {
+    n := g.times.TotalCount()
+    if n == 0 || d < g.min {
+        g.min = d
+    }
+    if d > g.max {
+        g.max = d
+    }
+    x := float64(d)
+    delta := x - g.mean
+    g.mean += delta / float64(n+1)
+    g.m2 += delta * (x - g.mean)
+    recordLatency(g.times, d)
+}
+
+// completed is the number of response times recorded.
+func (g *latencyGroup) completed() int64 {
+    return g.times.TotalCount()
+}
+
+func (g *latencyGroup) stdDev() time.Duration {
+    if g.completed() == 0 {
+        return 0
+    }
+    return time.Duration(math.Sqrt(g.m2 / float64(g.completed())))
+}
+
+// percentile returns the p-th percentile response time, accurate to the
+// histogram's three significant figures and kept within the exact minimum
+// and maximum.
+func (g *latencyGroup) percentile(p float64) time.Duration {
+    d := time.Duration(nearestRank(g.times, p))
+    if d < g.min {
+        return g.min
+    }
+    if d > g.max {
+        return g.max
+    }
+    return d
+}
+
+// nearestRank returns the p-th percentile of h using the nearest-rank method,
+// like computePercentile. ValueAtQuantile rounds the rank to the nearest
+// count instead, which in a sparse tail picks the next lower value.
+func nearestRank(h *hdrhistogram.Histogram, p float64) int64 {
+    n := h.TotalCount()
+    if n == 0 {
+        return 0
+    }
+    rank := math.Max(math.Ceil(p/100*float64(n)), 1)
+    // ValueAtQuantile takes the value at rank q/100*n + 0.5, rounded down
+    return h.ValueAtQuantile((rank - 0.25) / float64(n) * 100)
+}
+
+// streamStats holds the statistics of the measured samples of a run that
+// doesn't retain them, the counterpart of the functions summarizeSamples
+// calls.
+type streamStats struct {
+    mu          sync.Mutex
+    origin      time.Time // the start of the measurement, which the throughput series counts from
+    all         *latencyGroup
+    uncorrected *latencyGroup // response times measured from when each request was sent
+    ttfb        *latencyGroup
+    sizes       *hdrhistogram.Histogram
+    sizeTotal   int64
+    sizeMin     int64
+    sizeMax     int64
+    status      map[string]*latencyGroup
+    hosts       map[string]*latencyGroup
+    steps       map[string]*latencyGroup
+    phases      map[string]*latencyGroup // keyed by PhaseStats.Phase
+    clients     []ClientStats
+    series      []int64
+}
+
+var stream streamStats
+
+// maxResponseSize is the largest response size the size histogram tracks;
+// larger ones are recorded as this.
+const maxResponseSize = int64(1) << 40
+
+// reset clears the statistics for a run whose measurement starts at origin.
+func (st *streamStats) reset(origin time.Time) {
+    st.mu.Lock()
+    defer st.mu.Unlock()
+    st.origin = origin
+    st.all, st.uncorrected, st.ttfb = newLatencyGroup(), newLatencyGroup(), newLatencyGroup()
+    st.sizes = hdrhistogram.New(1, maxResponseSize, 3)
+    st.sizeTotal, st.sizeMin, st.sizeMax = 0, 0, 0
+    st.status = make(map[string]*latencyGroup)
+    st.hosts = make(map[string]*latencyGroup)
+    st.steps = make(map[string]*latencyGroup)
+    st.phases = make(map[string]*latencyGroup)
+    st.clients = make([]ClientStats, len(simClients))
+    st.series = nil
+}
+
+// group returns the group of key in groups, adding it if needed.
+func group(groups map[string]*latencyGroup, key string) *latencyGroup {
+    g, ok := groups[key]
+    if !ok {
+        g = newLatencyGroup()
+        groups[key] = g
+    }
+    return g
+}
+
+// add records measured samples.
+func (st *streamStats) add(samples []sample) {
+    st.mu.Lock()
+    defer st.mu.Unlock()
+    for i := range samples {
+        st.addSample(&samples[i])
+    }
+}
+
+func (st *streamStats) addSample(s *sample) {
+    if s.Host != "" {
+        group(st.hosts, s.Host).add(s)
+    }
+    if s.Step != "" {
+        group(st.steps, s.Step).add(s)
+    }
+    if s.Client > 0 {
+        cs := &st.clients[s.Client-1]
+        cs.Requests++
+        if s.Err != nil || s.Failed {
+            cs.Failed++
+        }
+    }
+    if s.Err != nil {
+        return
+    }
+
+    st.all.addTime(s.Duration)
+    st.uncorrected.addTime(s.Duration - s.Delay)
+    if s.Status > 0 {
+        group(st.status, fmt.Sprintf("%dxx", s.Status/100)).addTime(s.Duration)
+    }
+    if s.TTFB > 0 {
+        st.ttfb.addTime(s.TTFB)
+    }
+    if st.sizes.TotalCount() == 0 || s.Bytes < st.sizeMin {
+        st.sizeMin = s.Bytes
+    }
+    if s.Bytes > st.sizeMax {
+        st.sizeMax = s.Bytes
+    }
+    st.sizeTotal += s.Bytes
+    if s.Bytes > maxResponseSize {
+        st.sizes.RecordValue(maxResponseSize)
+    } else {
+        st.sizes.RecordValue(s.Bytes)
+    }
+
+    // As in throughputSeries, a request counts in the second it completed
+    second := int(s.Start.Add(s.Duration-s.Delay).Sub(st.origin) / time.Second)
+    if second < 0 {
+        second = 0
+    }
+    for len(st.series) <= second {
+        st.series = append(st.series, 0)
+    }
+    st.series[second]++
+}
+
+// addPhases records the phase durations a worker buffered.
+func (st *streamStats) addPhases(s *phaseSamples) {
+    st.mu.Lock()
+    defer st.mu.Unlock()
+    for i, durations := range [][]time.Duration{s.DNS, s.Connect, s.TLS, s.TTFB} {
+        for _, d := range durations {
+            group(st.phases, phaseNames[i]).addTime(d)
+        }
+    }
+}
+
+// completed returns the number of completed requests recorded.
+func (st *streamStats) completed() int64 {
+    st.mu.Lock()
+    defer st.mu.Unlock()
+    if st.all == nil {
+        return 0
+    }
+    return st.all.completed()
+}
+
+// summarizeStream fills in the statistics of r that summarizeSamples
+// derives from the samples, from stream instead. The percentiles are
+// accurate to three significant figures; the counts, minimum, maximum and
+// mean are exact.
+func summarizeStream(r *Result, window time.Duration) {
+    st := &stream
+    st.mu.Lock()
+    defer st.mu.Unlock()
+
+    all := st.all
+    r.Mean = time.Duration(all.mean)
+    r.StdDev = all.stdDev()
+    r.Min = all.min
+    r.Max = all.max
+    r.Median = all.percentile(50)
+    r.P75 = all.percentile(75)
+    r.P90 = all.percentile(90)
+    r.P95 = all.percentile(95)
+    r.P99 = all.percentile(99)
+    r.P999 = all.percentile(99.9)
+    r.Throughput = float64(all.completed()) / window.Seconds()
+
+    r.StatusLatency = make(map[string]LatencyStats, len(st.status))
+    for key, g := range st.status {
+        r.StatusLatency[key] = LatencyStats{Count: int(g.completed()), Mean: time.Duration(g.mean), P99: g.percentile(99)}
+    }
+    if len(st.hosts) > 1 {
+        r.Hosts = make(map[string]HostStats, len(st.hosts))
+        for host, g := range st.hosts {
+            r.Hosts[host] = HostStats{
+                Requests:          g.requests,
+                Failed:            g.failed,
+                Mean:              time.Duration(g.mean),
+                Median:            g.percentile(50),
+                P99:               g.percentile(99),
+                ReusedConnections: g.reused,
+                NewConnections:    g.fresh,
+            }
+        }
+    }
+    for _, step := range scriptSteps {
+        ss := StepStats{Name: step.name}
+        if g, ok := st.steps[step.name]; ok {
+            ss.Requests, ss.Failed = g.requests, g.failed
+            ss.Mean, ss.Median, ss.P99 = time.Duration(g.mean), g.percentile(50), g.percentile(99)
+        }
+        r.Steps = append(r.Steps, ss)
+    }
+    if len(simClients) > 0 {
+        r.Clients = append([]ClientStats(nil), st.clients...)
+    }
+    r.ThroughputSeries = append([]int64(nil), st.series...)
+    if r.TargetRate > 0 {
+        r.UncorrectedP99 = st.uncorrected.percentile(99)
+    }
+    if g := st.ttfb; g.completed() > 0 {
+        r.FirstByte = &FirstByteStats{
+            Median: g.percentile(50),
+            P90:    g.percentile(90),
+            P95:    g.percentile(95),
+            P99:    g.percentile(99),
+            Max:    g.max,
+        }
+    }
+    if n := st.sizes.TotalCount(); n > 0 {
+        r.ResponseSizes = &SizeStats{
+            Min:    st.sizeMin,
+            Mean:   st.sizeTotal / n,
+            Median: nearestRank(st.sizes, 50),
+            P99:    nearestRank(st.sizes, 99),
+            Max:    st.sizeMax,
+        }
+    }
+}
+
+// streamLatencyBars returns the exact minimum and maximum response times in
+// stream, and each non-empty bar of its histogram as the midpoint in
+// milliseconds and the count.
+func streamLatencyBars() (min, max time.Duration, bars plotter.XYs) {
+    stream.mu.Lock()
+    defer stream.mu.Unlock()
+    if stream.all == nil {
+        return 0, 0, nil
+    }
+    for _, bar := range stream.all.times.Distribution() {
+        if bar.Count > 0 {
+            mid := float64(bar.From+bar.To) / 2 / float64(time.Millisecond)
+            bars = append(bars, plotter.XY{X: mid, Y: float64(bar.Count)})
+        }
+    }
+    return stream.all.min, stream.all.max, bars
+}
+
+// streamPhaseStats is phaseSamples.summarize for a run that doesn't retain
+// its samples.
+func streamPhaseStats() []PhaseStats {
+    stream.mu.Lock()
+    defer stream.mu.Unlock()
+    if len(stream.phases) == 0 {
+        return nil
+    }
+    var stats []PhaseStats
+    for _, phase := range phaseNames {
+        ps := PhaseStats{Phase: phase}
+        if g, ok := stream.phases[phase]; ok {
+            ps.Count, ps.Mean, ps.P99 = int(g.completed()), time.Duration(g.mean), g.percentile(99)
+        }
+        stats = append(stats, ps)
+    }
+    return stats
+}
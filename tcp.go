@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// tcpReadSize is the most a -protocol tcp call reads of the response, which
+// is whatever arrives in the first read.
+const tcpReadSize = 64 * 1024
+
+// newTCPOpener returns a callOpener for -protocol tcp. Every call opens a
+// new connection to addr, so that the time to connect is part of each
+// measurement, and with a payload sends it and waits for the first bytes of
+// a response before closing. The connect time and, with a payload, the time
+// to the first response byte are reported as phases.
+func newTCPOpener(addr string) callOpener {
+    return func(context.Context) (callFunc, func(), error) {
+        return func(ctx context.Context) (int64, int64, error) {
+            return tcpCall(ctx, addr)
+        }, func() {}, nil
+    }
+}
+
+func tcpCall(ctx context.Context, addr string) (int64, int64, error) {
+    timings := callTimings(ctx)
+    start := time.Now()
+    conn, err := dialContext(ctx, "tcp", addr)
+    if err != nil {
+        return 0, 0, err
+    }
+    defer conn.Close()
+    if timings != nil {
+        timings.Connect = time.Since(start)
+    }
+
+    message := payloadBytes
+    if payloadTemplate != nil {
+        vars := requestVars{Seq: atomic.AddUint64(&requestSeq, 1), Rand: sharedRand.Int63()}
+        rendered, err := renderTemplate(payloadTemplate, vars)
+        if err != nil {
+            return 0, 0, err
+        }
+        message = rendered
+    }
+    if len(message) == 0 {
+        return 0, 0, nil
+    }
+
+    // Deadlines are the only way to bound a read, so cancellation is turned
+    // into an immediate one
+    if deadline, ok := ctx.Deadline(); ok {
+        conn.SetDeadline(deadline)
+    }
+    stop := make(chan struct{})
+    stopped := make(chan struct{})
+    go func() {
+        defer close(stopped)
+        select {
+        case <-ctx.Done():
+            conn.SetDeadline(time.Now())
+        case <-stop:
+        }
+    }()
+    defer func() {
+        close(stop)
+        <-stopped
+    }()
+
+    if _, err := conn.Write(message); err != nil {
+        return 0, 0, err
+    }
+    buf := make([]byte, tcpReadSize)
+    n, err := conn.Read(buf)
+    if err != nil {
+        return int64(len(message)), int64(n), err
+    }
+    if timings != nil {
+        timings.TTFB = time.Since(start)
+    }
+    return int64(len(message)), int64(n), nil
+}
+
+// checkTCPAddr reports whether addr is the host:port -protocol tcp needs.
+func checkTCPAddr(addr string) bool {
+    host, port, err := net.SplitHostPort(addr)
+    if err != nil || host == "" || strings.Contains(host, "/") {
+        return false
+    }
+    _, err = strconv.ParseUint(port, 10, 16)
+    return err == nil
+}
@@ -0,0 +1,44 @@
+package main
+
+import "sync/atomic"
+
+// resumedSessions and fullHandshakes count the TLS handshakes of the new
+// connections opened during the measurement, by whether they resumed an
+// earlier session from the client session cache.
+var resumedSessions, fullHandshakes int64
+
+// TLSSessionStats reports how many new TLS connections resumed a session
+// rather than doing a full handshake. A low rate with the session cache on
+// means the server isn't issuing or accepting session tickets, and every
+// connection pays for a full handshake.
+type TLSSessionStats struct {
+    Resumed        int64   `json:"resumed"`
+    FullHandshakes int64   `json:"full_handshakes"`
+    ResumeRate     float64 `json:"resume_rate"` // percent of handshakes that resumed
+    Cache          bool    `json:"cache"`       // whether -tls-session-cache was on
+}
+
+// countHandshake counts the TLS handshake of a new connection.
+func countHandshake(resumed bool) {
+    if resumed {
+        atomic.AddInt64(&resumedSessions, 1)
+    } else {
+        atomic.AddInt64(&fullHandshakes, 1)
+    }
+}
+
+// tlsSessionStats returns the handshakes counted so far, or nil when there
+// were none, as with plain HTTP or connections that were all reused.
+func tlsSessionStats() *TLSSessionStats {
+    stats := &TLSSessionStats{
+        Resumed:        atomic.LoadInt64(&resumedSessions),
+        FullHandshakes: atomic.LoadInt64(&fullHandshakes),
+        Cache:          *tlsSessionCache,
+    }
+    total := stats.Resumed + stats.FullHandshakes
+    if total == 0 {
+        return nil
+    }
+    stats.ResumeRate = float64(stats.Resumed) / float64(total) * 100
+    return stats
+}
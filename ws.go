@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// newWebSocketOpener returns a callOpener for -protocol ws. Each worker
+// holds one connection to target and every call sends the payload as a text
+// message and waits for the echo. A connection that fails mid-message is
+// redialed before the next call; if that fails too, the worker stops and the
+// failure is counted as a connection failure rather than a message error.
+func newWebSocketOpener(target string) callOpener {
+    return func(ctx context.Context) (callFunc, func(), error) {
+        ws := &wsConn{target: target}
+        if err := ws.dial(ctx); err != nil {
+            return nil, nil, err
+        }
+        return ws.call, ws.close, nil
+    }
+}
+
+// wsConn is the connection held by one -protocol ws worker.
+type wsConn struct {
+    target string
+    conn   *websocket.Conn
+}
+
+func (w *wsConn) dial(ctx context.Context) error {
+    tlsConfig, err := buildTLSConfig()
+    if err != nil {
+        return err
+    }
+    dialer := websocket.Dialer{
+        Proxy:            websocket.DefaultDialer.Proxy,
+        NetDialContext:   dialContext,
+        HandshakeTimeout: *timeout,
+        TLSClientConfig:  tlsConfig,
+    }
+    conn, _, err := dialer.DialContext(ctx, w.target, requestHeaders)
+    if err != nil {
+        return err
+    }
+    w.conn = conn
+    return nil
+}
+
+func (w *wsConn) close() {
+    if w.conn != nil {
+        w.conn.Close()
+    }
+}
+
+// call sends one message and reads the echo within ctx's deadline.
+func (w *wsConn) call(ctx context.Context) (int64, int64, error) {
+    if w.conn == nil {
+        if err := w.dial(ctx); err != nil {
+            atomic.AddInt64(&connectFailures, 1)
+            return 0, 0, errStopWorker
+        }
+    }
+
+    message := payloadBytes
+    if payloadTemplate != nil {
+        vars := requestVars{Seq: atomic.AddUint64(&requestSeq, 1), Rand: sharedRand.Int63()}
+        rendered, err := renderTemplate(payloadTemplate, vars)
+        if err != nil {
+            return 0, 0, err
+        }
+        message = rendered
+    }
+
+    deadline, ok := ctx.Deadline()
+    if !ok {
+        deadline = time.Now().Add(*timeout)
+    }
+    w.conn.SetWriteDeadline(deadline)
+    w.conn.SetReadDeadline(deadline)
+
+    // gorilla/websocket only honors deadlines, so cancellation is turned
+    // into an immediate one. The watcher is waited for on return so it
+    // can't touch the deadline of a later call.
+    conn := w.conn
+    stop := make(chan struct{})
+    stopped := make(chan struct{})
+    go func() {
+        defer close(stopped)
+        select {
+        case <-ctx.Done():
+            conn.SetReadDeadline(time.Now())
+        case <-stop:
+        }
+    }()
+    defer func() {
+        close(stop)
+        <-stopped
+    }()
+
+    if err := w.conn.WriteMessage(websocket.TextMessage, message); err != nil {
+        w.drop()
+        return 0, 0, err
+    }
+    _, reply, err := w.conn.ReadMessage()
+    if err != nil {
+        w.drop()
+        return int64(len(message)), 0, err
+    }
+    return int64(len(message)), int64(len(reply)), nil
+}
+
+// drop closes a connection left unusable by a failed message so the next
+// call redials.
+func (w *wsConn) drop() {
+    w.conn.Close()
+    w.conn = nil
+}